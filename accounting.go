@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	ruleDownloadBytes     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "rule", "download_bytes_total"), "Number of bytes downloaded by connections matching the rule.", []string{"rule", "payload"}, nil)
+	ruleUploadBytes       = prometheus.NewDesc(prometheus.BuildFQName(namespace, "rule", "upload_bytes_total"), "Number of bytes uploaded by connections matching the rule.", []string{"rule", "payload"}, nil)
+	outboundDownloadBytes = prometheus.NewDesc(prometheus.BuildFQName(namespace, "outbound", "download_bytes_total"), "Number of bytes downloaded through the outbound proxy.", []string{"outbound"}, nil)
+	outboundUploadBytes   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "outbound", "upload_bytes_total"), "Number of bytes uploaded through the outbound proxy.", []string{"outbound"}, nil)
+)
+
+type byteCounter struct {
+	Upload   int64
+	Download int64
+}
+
+func (c *byteCounter) add(d *ConnectionDelta) {
+	c.Upload += d.Upload
+	c.Download += d.Download
+}
+
+type ruleKey struct {
+	rule    string
+	payload string
+}
+
+// TrafficAccounting credits connection deltas to the matched rule and to the outbound proxy.
+type TrafficAccounting struct {
+	mutex     sync.Mutex
+	rules     map[ruleKey]*byteCounter
+	outbounds map[string]*byteCounter
+}
+
+func NewTrafficAccounting() *TrafficAccounting {
+	return &TrafficAccounting{
+		rules:     make(map[ruleKey]*byteCounter),
+		outbounds: make(map[string]*byteCounter),
+	}
+}
+
+func (a *TrafficAccounting) ObserveConnections(deltas []*ConnectionDelta) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, d := range deltas {
+		if d.Upload == 0 && d.Download == 0 {
+			continue
+		}
+		rk := ruleKey{rule: d.Rule, payload: d.RulePayload}
+		rc, ok := a.rules[rk]
+		if !ok {
+			rc = &byteCounter{}
+			a.rules[rk] = rc
+		}
+		rc.add(d)
+		outbound := d.Outbound()
+		oc, ok := a.outbounds[outbound]
+		if !ok {
+			oc = &byteCounter{}
+			a.outbounds[outbound] = oc
+		}
+		oc.add(d)
+	}
+}
+
+func (a *TrafficAccounting) Describe(descs chan<- *prometheus.Desc) {
+	descs <- ruleDownloadBytes
+	descs <- ruleUploadBytes
+	descs <- outboundDownloadBytes
+	descs <- outboundUploadBytes
+}
+
+func (a *TrafficAccounting) Collect(metrics chan<- prometheus.Metric) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for k, c := range a.rules {
+		metrics <- prometheus.MustNewConstMetric(ruleDownloadBytes, prometheus.CounterValue, float64(c.Download), k.rule, k.payload)
+		metrics <- prometheus.MustNewConstMetric(ruleUploadBytes, prometheus.CounterValue, float64(c.Upload), k.rule, k.payload)
+	}
+	for outbound, c := range a.outbounds {
+		metrics <- prometheus.MustNewConstMetric(outboundDownloadBytes, prometheus.CounterValue, float64(c.Download), outbound)
+		metrics <- prometheus.MustNewConstMetric(outboundUploadBytes, prometheus.CounterValue, float64(c.Upload), outbound)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -9,61 +11,300 @@ import (
 	"github.com/prometheus/common/version"
 	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/spf13/cobra"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	namespace = "clash"
+	// otherLabel is the label value that collects what is beyond the cardinality limit of a metric.
+	otherLabel = "__other__"
 )
 
 var (
 	clashInfo          = prometheus.NewDesc(prometheus.BuildFQName(namespace, "version", "info"), "Clash version info.", []string{"premium", "version"}, nil)
-	clashUp            = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "up"), "Was the last scrape of Clash successful.", nil, nil)
+	clashUp            = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "up"), "Was the last scrape of Clash successful, i.e. did at least one collector get an answer.", nil, nil)
 	proxyDelay         = prometheus.NewDesc(prometheus.BuildFQName(namespace, "proxy", "delay"), "Proxy delay.", []string{"type", "name", "provider"}, nil)
+	proxyDelayProbed   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "proxy", "delay_last_probe_timestamp_seconds"), "Unix time of the last delay probe of the proxy.", []string{"type", "name", "provider"}, nil)
 	downloadTotal      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection", "download_total"), "Number of bytes that downloaded by clash.", nil, nil)
 	uploadTotal        = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection", "upload_total"), "Number of bytes that uploaded by clash.", nil, nil)
-	connectionDownload = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection", "download"), "Number of bytes for specific connection that downloaded by clash.", nil, nil)
-	connectionUpload   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection", "upload"), "Number of bytes for specific connection that uploaded by clash.", nil, nil)
+	rulesCount         = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "rules"), "Number of rules by type and target proxy or group.", []string{"type", "target"}, nil)
+	rulesTotal         = prometheus.NewDesc(prometheus.BuildFQName(namespace, "rules", "total"), "Number of rules.", nil, nil)
+	providerUpdated    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "provider", "updated_timestamp_seconds"), "Unix time the proxy provider was last updated.", []string{"provider", "vehicle"}, nil)
+	subscriptionBytes  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "provider", "subscription_bytes"), "Number of bytes used of the proxy provider subscription.", []string{"provider", "direction"}, nil)
+	subscriptionTotal  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "provider", "subscription_total_bytes"), "Number of bytes available to the proxy provider subscription.", []string{"provider"}, nil)
+	subscriptionExpire = prometheus.NewDesc(prometheus.BuildFQName(namespace, "provider", "subscription_expire_timestamp_seconds"), "Unix time the proxy provider subscription expires.", []string{"provider"}, nil)
+
+	scrapeDuration = prometheus.NewDesc(prometheus.BuildFQName(namespace, "scrape", "collector_duration_seconds"), "Duration of a collector scrape.", []string{"collector"}, nil)
+	scrapeSuccess  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "scrape", "collector_success"), "Whether a collector succeeded.", []string{"collector"}, nil)
 )
 
+var errTrafficNotConnected = errors.New("traffic stream is not connected")
+
+// connectionCollector exports metrics from the connection deltas it observed.
+type connectionCollector interface {
+	ConnectionObserver
+	prometheus.Collector
+}
+
+// scraper is a named sub-collector of the Exporter.
+type scraper struct {
+	name string
+	fn   func(metrics chan<- prometheus.Metric) error
+	// indirect scrapers do not tell whether Clash answers the exporter now,
+	// e.g. because they serve the results of background tasks.
+	indirect bool
+}
+
 type Exporter struct {
 	mutex sync.RWMutex
 
 	Client         IClient
 	testUrl        string
 	testUrlTimeout time.Duration
+	probeInterval  time.Duration
+	probeJitter    time.Duration
+	classifier     *ProxyClassifier
+
+	trackConnections        bool
+	connectionsPollInterval time.Duration
+	connectionCollectors    []connectionCollector
 
+	prober       *DelayProber
+	tracker      *ConnectionTracker
+	groups       *GroupTracker
+	configs      *ConfigTracker
+	totals       *TrafficTotals
+	traffic      *TrafficMonitor
+	logs         *LogMonitor
+	logLevel     string
+	refresher    *RuleProviderRefresher
+	forwarder    *LogForwarder
+	publicBind   publicBindCache
 	totalScrapes prometheus.Counter
+
+	// collectors are fed in the background and collected on every scrape.
+	collectors []prometheus.Collector
+}
+
+// ExporterOption configures optional behaviors of an Exporter.
+type ExporterOption func(*Exporter)
+
+// WithProbeInterval sets how often the background prober tests proxy delays.
+func WithProbeInterval(interval, jitter time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.probeInterval = interval
+		e.probeJitter = jitter
+	}
+}
+
+// WithProxyClassifier overrides which proxies are probed as leaf proxies.
+func WithProxyClassifier(classifier *ProxyClassifier) ExporterOption {
+	return func(e *Exporter) {
+		e.classifier = classifier
+	}
+}
+
+// WithConnectionTracking diffs successive connection snapshots to account traffic by rule and outbound.
+func WithConnectionTracking() ExporterOption {
+	return func(e *Exporter) {
+		e.trackConnections = true
+	}
+}
+
+// WithConnectionsPollInterval takes the connection snapshots of tracked connections every pollInterval,
+// or on every scrape if pollInterval is 0.
+func WithConnectionsPollInterval(pollInterval time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.connectionsPollInterval = pollInterval
+	}
+}
+
+// WithConnectionCollector adds a collector that observes connection deltas, which makes the exporter track connections.
+func WithConnectionCollector(c connectionCollector) ExporterOption {
+	return func(e *Exporter) {
+		e.connectionCollectors = append(e.connectionCollectors, c)
+	}
+}
+
+// WithTrafficStreams subscribes the /traffic and /memory streams for real-time gauges with the peak over peakWindow.
+func WithTrafficStreams(peakWindow time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.traffic = NewTrafficMonitor(peakWindow)
+	}
+}
+
+// WithLogStream subscribes the /logs stream at level to count log messages and dial errors.
+func WithLogStream(level string) ExporterOption {
+	return func(e *Exporter) {
+		e.logs = NewLogMonitor()
+		e.logLevel = level
+		e.collectors = append(e.collectors, e.logs)
+	}
+}
+
+// WithLogForwarder forwards the /logs stream with its own subscription at the level of f.
+func WithLogForwarder(f *LogForwarder) ExporterOption {
+	return func(e *Exporter) {
+		e.forwarder = f
+		e.collectors = append(e.collectors, f)
+	}
+}
+
+// WithRuleProviderMaxAge makes the exporter update HTTP rule providers older than maxAge.
+func WithRuleProviderMaxAge(maxAge time.Duration) ExporterOption {
+	return func(e *Exporter) {
+		e.refresher = NewRuleProviderRefresher(e.Client, maxAge)
+		e.collectors = append(e.collectors, e.refresher)
+	}
+}
+
+// WithTrafficTotals keeps the traffic totals of Clash monotonic across its restarts with totals, e.g. loaded from a state file.
+func WithTrafficTotals(totals *TrafficTotals) ExporterOption {
+	return func(e *Exporter) {
+		e.totals = totals
+	}
 }
 
 // NewExporter returns an initialized Exporter.
-func NewExporter(client IClient, testUrl string, testUrlTimeout time.Duration) (*Exporter, error) {
-	return &Exporter{
+func NewExporter(client IClient, testUrl string, testUrlTimeout time.Duration, opts ...ExporterOption) (*Exporter, error) {
+	e := &Exporter{
 		Client:         client,
 		testUrl:        testUrl,
 		testUrlTimeout: testUrlTimeout,
+		probeInterval:  DefaultProbeInterval,
+		probeJitter:    DefaultProbeJitter,
+		classifier:     &ProxyClassifier{},
+		groups:         NewGroupTracker(),
+		configs:        NewConfigTracker(),
 		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "exporter_scrapes_total",
 			Help:      "Current total Clash scrapes.",
 		}),
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.prober = NewDelayProber(client, e.classifier, testUrl, testUrlTimeout, e.probeInterval, e.probeJitter)
+	if e.trackConnections {
+		e.connectionCollectors = append([]connectionCollector{NewTrafficAccounting(), NewConnectionStats(), NewInboundTraffic()}, e.connectionCollectors...)
+	}
+	if len(e.connectionCollectors) > 0 {
+		e.tracker = NewConnectionTracker()
+		for _, c := range e.connectionCollectors {
+			e.tracker.AddObserver(c)
+		}
+	}
+	return e, nil
+}
+
+// Run starts the background tasks of the Exporter and blocks until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.prober.Run(ctx)
+	}()
+	var subscribers []*StreamSubscriber
+	if e.traffic != nil {
+		traffic := NewStreamSubscriber(e.Client, trafficUrl, e.traffic.HandleTraffic)
+		traffic.onReconnect = e.traffic.ResetTraffic
+		memory := NewStreamSubscriber(e.Client, memoryUrl, e.traffic.HandleMemory)
+		memory.onReconnect = e.traffic.ResetMemory
+		subscribers = append(subscribers, traffic, memory)
+	}
+	if e.logs != nil {
+		subscribers = append(subscribers, NewStreamSubscriber(e.Client, LogsUrl(e.logLevel), e.logs.HandleLog))
+	}
+	if e.forwarder != nil {
+		forward := NewStreamSubscriber(e.Client, LogsUrl(e.forwarder.level), e.forwarder.HandleLog)
+		forward.onReconnect = e.forwarder.StreamBroken
+		subscribers = append(subscribers, forward)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.forwarder.Run(ctx)
+		}()
+	}
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *StreamSubscriber) {
+			defer wg.Done()
+			s.Run(ctx)
+		}(s)
+	}
+	if e.tracker != nil && e.connectionsPollInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.pollConnections(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (e *Exporter) pollConnections(ctx context.Context) {
+	ticker := time.NewTicker(e.connectionsPollInterval)
+	defer ticker.Stop()
+	for {
+		s, err := e.Client.GetConnections()
+		if err != nil {
+			level.Warn(logger).Log("msg", "error when poll connections", "err", err)
+		} else {
+			e.tracker.Update(s, time.Now())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
 	descs <- clashInfo
 	descs <- clashUp
 	descs <- proxyDelay
+	descs <- proxyDelayProbed
 	descs <- downloadTotal
 	descs <- uploadTotal
-	descs <- connectionDownload
-	descs <- connectionUpload
+	descs <- restartsDetected
+	descs <- processStartTime
+	descs <- rulesCount
+	descs <- rulesTotal
+	descs <- ruleProviderRules
+	descs <- ruleProviderUpdated
+	descs <- providerUpdated
+	descs <- subscriptionBytes
+	descs <- subscriptionTotal
+	descs <- subscriptionExpire
+	descs <- controllerUnauthenticated
+	descs <- allowLanWithoutAuth
+	descs <- controllerPublicBind
+	descs <- scrapeDuration
+	descs <- scrapeSuccess
 	descs <- e.totalScrapes.Desc()
+	for _, c := range e.connectionCollectors {
+		c.Describe(descs)
+	}
+	e.groups.Describe(descs)
+	e.configs.Describe(descs)
+	if e.traffic != nil {
+		e.traffic.Describe(descs)
+	}
+	for _, c := range e.collectors {
+		c.Describe(descs)
+	}
 }
 
 func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
@@ -73,6 +314,9 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 	up := e.scrape(metrics)
 	metrics <- prometheus.MustNewConstMetric(clashUp, prometheus.GaugeValue, up)
 	metrics <- e.totalScrapes
+	for _, c := range e.collectors {
+		c.Collect(metrics)
+	}
 }
 
 func (e *Exporter) scrapeVersion(metrics chan<- prometheus.Metric) error {
@@ -84,64 +328,103 @@ func (e *Exporter) scrapeVersion(metrics chan<- prometheus.Metric) error {
 	return nil
 }
 
+func (e *Exporter) collectDelays(metrics chan<- prometheus.Metric, results []*delayResult) {
+	for _, r := range results {
+		metrics <- prometheus.MustNewConstMetric(proxyDelay, prometheus.GaugeValue, float64(r.Delay), r.Type, r.Name, r.Provider)
+		metrics <- prometheus.MustNewConstMetric(proxyDelayProbed, prometheus.GaugeValue, float64(r.Time.UnixNano())/1e9, r.Type, r.Name, r.Provider)
+	}
+}
+
 func (e *Exporter) scrapeProxies(metrics chan<- prometheus.Metric) error {
+	results, err := e.prober.Proxies()
+	e.collectDelays(metrics, results)
+	return err
+}
+
+func (e *Exporter) scrapeProvidersProxies(metrics chan<- prometheus.Metric) error {
+	results, err := e.prober.ProvidersProxies()
+	e.collectDelays(metrics, results)
+	return err
+}
+
+func (e *Exporter) scrapeGroups(metrics chan<- prometheus.Metric) error {
 	proxies, err := e.Client.GetProxies()
 	if err != nil {
 		return err
 	}
-	for proxyName, delay := range GetAllProxyDelay(proxies, IsConnectionProxy, e.Client, e.testUrl, e.testUrlTimeout) {
-		proxy := proxies[proxyName]
-		metrics <- prometheus.MustNewConstMetric(proxyDelay, prometheus.GaugeValue, float64(delay), proxy.Type, proxy.Name, "")
+	e.groups.Update(proxies)
+	e.groups.Collect(metrics)
+	return nil
+}
+
+func (e *Exporter) scrapeRules(metrics chan<- prometheus.Metric) error {
+	rules, err := e.Client.GetRules()
+	if err != nil {
+		return err
+	}
+	type ruleCountKey struct {
+		typ    string
+		target string
+	}
+	counts := make(map[ruleCountKey]int)
+	for _, r := range rules {
+		counts[ruleCountKey{typ: r.Type, target: r.Proxy}]++
+	}
+	for k, n := range counts {
+		metrics <- prometheus.MustNewConstMetric(rulesCount, prometheus.GaugeValue, float64(n), k.typ, k.target)
 	}
+	metrics <- prometheus.MustNewConstMetric(rulesTotal, prometheus.GaugeValue, float64(len(rules)))
 	return nil
 }
 
-func (e *Exporter) scrapeProvidersProxies(metrics chan<- prometheus.Metric) error {
-	providers, err := e.Client.GetProvidersProxies()
+func (e *Exporter) scrapeRuleProviders(metrics chan<- prometheus.Metric) error {
+	providers, err := e.Client.GetProvidersRules()
 	if err != nil {
 		return err
 	}
-	wg := sync.WaitGroup{}
-	count := 0
-	for _, provider := range providers {
-		if provider.VehicleType == VehicleTypeHTTP || provider.VehicleType == VehicleTypeFile {
-			wg.Add(1)
-			count += 1
-			go func(provider *Provider) {
-				defer wg.Done()
-				err = e.Client.ProviderProxiesHealthCheck(provider.Name)
-				if err != nil {
-					level.Error(logger).Log("msg", "error when do health check", "err", err, "provider", provider.Name)
-				}
-			}(provider)
+	for _, p := range providers {
+		metrics <- prometheus.MustNewConstMetric(ruleProviderRules, prometheus.GaugeValue, float64(p.RuleCount), p.Name, p.Behavior, p.VehicleType)
+		if !p.UpdatedAt.IsZero() {
+			metrics <- prometheus.MustNewConstMetric(ruleProviderUpdated, prometheus.GaugeValue, float64(p.UpdatedAt.Unix()), p.Name)
 		}
 	}
-	wg.Wait()
-	if count == 0 {
-		level.Info(logger).Log("msg", "no provider do health check")
-		return nil
+	if e.refresher != nil {
+		e.refresher.Refresh(providers, time.Now())
+	}
+	return nil
+}
+
+func (e *Exporter) scrapeConfigs(metrics chan<- prometheus.Metric) error {
+	configs, err := e.Client.GetConfigs()
+	if err != nil {
+		return err
 	}
+	if err := e.configs.Update(configs); err != nil {
+		return err
+	}
+	e.configs.Collect(metrics)
+	e.collectConfigsSecurity(configs, metrics)
+	return nil
+}
 
-	providers, err = e.Client.GetProvidersProxies()
+func (e *Exporter) scrapeProviders(metrics chan<- prometheus.Metric) error {
+	providers, err := e.Client.GetProvidersProxies()
 	if err != nil {
 		return err
 	}
 	for _, provider := range providers {
-		if provider.VehicleType == VehicleTypeHTTP || provider.VehicleType == VehicleTypeFile {
-			for _, proxy := range provider.Proxies {
-				if IsConnectionProxy(proxy) {
-					n := len(proxy.History)
-					if n >= 1 && time.Since(proxy.History[n-1].Time) <= 1*time.Minute {
-						delay := proxy.History[n-1].Delay
-						if delay == 0 {
-							delay = MaxDelay
-						}
-						metrics <- prometheus.MustNewConstMetric(proxyDelay, prometheus.GaugeValue, float64(delay), proxy.Type, proxy.Name, provider.Name)
-					} else {
-						level.Error(logger).Log("msg", "provider proxy should have at least one history", "proxy", proxy.Name, "providerName", provider.Name)
-					}
-				}
-			}
+		if !provider.UpdatedAt.IsZero() {
+			metrics <- prometheus.MustNewConstMetric(providerUpdated, prometheus.GaugeValue, float64(provider.UpdatedAt.Unix()), provider.Name, provider.VehicleType)
+		}
+		info := provider.SubscriptionInfo
+		if info == nil {
+			continue
+		}
+		metrics <- prometheus.MustNewConstMetric(subscriptionBytes, prometheus.GaugeValue, float64(info.Upload), provider.Name, "upload")
+		metrics <- prometheus.MustNewConstMetric(subscriptionBytes, prometheus.GaugeValue, float64(info.Download), provider.Name, "download")
+		metrics <- prometheus.MustNewConstMetric(subscriptionTotal, prometheus.GaugeValue, float64(info.Total), provider.Name)
+		if info.Expire > 0 {
+			metrics <- prometheus.MustNewConstMetric(subscriptionExpire, prometheus.GaugeValue, float64(info.Expire), provider.Name)
 		}
 	}
 	return nil
@@ -152,39 +435,81 @@ func (e *Exporter) scrapeConnections(metrics chan<- prometheus.Metric) error {
 	if err != nil {
 		return err
 	}
-	metrics <- prometheus.MustNewConstMetric(downloadTotal, prometheus.CounterValue, float64(s.DownloadTotal))
-	metrics <- prometheus.MustNewConstMetric(uploadTotal, prometheus.CounterValue, float64(s.UploadTotal))
-	// TODO: 连接不是一直存在的，相同目的地址可能有多个连接，需要修改 clash 数据
-	//for _, c := range s.Connections {
-	//	metrics <- prometheus.MustNewConstMetric(connectionDownload, prometheus.CounterValue, float64(c.DownloadTotal))
-	//	metrics <- prometheus.MustNewConstMetric(connectionUpload, prometheus.CounterValue, float64(c.UploadTotal))
-	//}
+	if e.totals != nil {
+		e.totals.Update(s, time.Now())
+		e.totals.Collect(metrics)
+	} else {
+		metrics <- prometheus.MustNewConstMetric(downloadTotal, prometheus.CounterValue, float64(s.DownloadTotal))
+		metrics <- prometheus.MustNewConstMetric(uploadTotal, prometheus.CounterValue, float64(s.UploadTotal))
+	}
+	// Connections come and go, so their bytes are exported by the collectors of the tracker instead.
+	if e.tracker != nil && e.connectionsPollInterval == 0 {
+		e.tracker.Update(s, time.Now())
+	}
+	for _, c := range e.connectionCollectors {
+		c.Collect(metrics)
+	}
+	return nil
+}
+
+func (e *Exporter) scrapeTraffic(metrics chan<- prometheus.Metric) error {
+	e.traffic.Collect(metrics)
+	if !e.traffic.Connected() {
+		return errTrafficNotConnected
+	}
 	return nil
 }
 
+func (e *Exporter) scrapers() []scraper {
+	scrapers := []scraper{
+		{name: "version", fn: e.scrapeVersion},
+		{name: "proxies", fn: e.scrapeProxies, indirect: true},
+		{name: "providers_proxies", fn: e.scrapeProvidersProxies, indirect: true},
+		{name: "groups", fn: e.scrapeGroups},
+		{name: "rules", fn: e.scrapeRules},
+		{name: "rule_providers", fn: e.scrapeRuleProviders},
+		{name: "configs", fn: e.scrapeConfigs},
+		// security requests Clash without the secret on purpose.
+		{name: "security", fn: e.scrapeSecurity, indirect: true},
+		{name: "providers", fn: e.scrapeProviders},
+		{name: "connections", fn: e.scrapeConnections},
+	}
+	if e.traffic != nil {
+		scrapers = append(scrapers, scraper{name: "traffic", fn: e.scrapeTraffic, indirect: true})
+	}
+	return scrapers
+}
+
+// scrape runs all scrapers concurrently and reports 1 if Clash answered at least one of the scrapers that are not indirect.
 func (e *Exporter) scrape(metrics chan<- prometheus.Metric) (up float64) {
 	e.totalScrapes.Inc()
-	errors := make([]error, 0)
-	scrapes := []func(metrics chan<- prometheus.Metric) error{
-		e.scrapeVersion, e.scrapeProxies, e.scrapeProvidersProxies, e.scrapeConnections,
-	}
+	scrapers := e.scrapers()
 	wg := sync.WaitGroup{}
-	wg.Add(len(scrapes))
-	for _, fn := range scrapes {
-		go func(fn func(metrics chan<- prometheus.Metric) error) {
+	wg.Add(len(scrapers))
+	var mu sync.Mutex
+	for _, s := range scrapers {
+		go func(s scraper) {
 			defer wg.Done()
-			err := fn(metrics)
+			begin := time.Now()
+			err := s.fn(metrics)
+			duration := time.Since(begin)
+			success := 0.0
 			if err != nil {
-				level.Warn(logger).Log("msg", "error when get proxy delay", "err", err)
+				level.Error(logger).Log("msg", "error when scrape clash", "collector", s.name, "duration_seconds", duration.Seconds(), "err", err)
+			} else {
+				success = 1
+				if !s.indirect {
+					mu.Lock()
+					up = 1
+					mu.Unlock()
+				}
 			}
-		}(fn)
+			metrics <- prometheus.MustNewConstMetric(scrapeDuration, prometheus.GaugeValue, duration.Seconds(), s.name)
+			metrics <- prometheus.MustNewConstMetric(scrapeSuccess, prometheus.GaugeValue, success, s.name)
+		}(s)
 	}
 	wg.Wait()
-	if len(errors) > 0 {
-		level.Error(logger).Log("msg", "error when scrape clash", "err", errors)
-		return 0
-	}
-	return 1
+	return up
 }
 
 func CollectToText(c prometheus.Collector) (string, error) {
@@ -209,11 +534,52 @@ var (
 	listenAddress string
 	tlsConfigPath string
 	metricsPath   string
+	configPath    string
 
 	externalController string
 	secret             string
+	transportConfig    TransportConfig
 	testUrl            string
 	testUrlTimeout     time.Duration
+	probeInterval      time.Duration
+	probeJitter        time.Duration
+	proxyIncludeTypes  []string
+	proxyExcludeTypes  []string
+	proxyExcludeNames  string
+	connectionTracking bool
+	connectionsPoll    time.Duration
+	clientTraffic      bool
+	leaseFiles         []string
+	staticDevicesFile  string
+	maxDevices         int
+	trafficStreams     bool
+	trafficPeakWindow  time.Duration
+	logLevel           string
+	ruleProviderMaxAge time.Duration
+	trafficTotals      bool
+	stateFile          string
+	stateSaveInterval  time.Duration
+	connHistograms     bool
+	durationBuckets    []float64
+	bytesBuckets       []float64
+	nativeBucketFactor float64
+	topDestinations    int
+	geoipCountryFile   string
+	geoipASNFile       string
+	processTraffic     bool
+	eventsFile         string
+	eventsMaxSize      int64
+	eventsMaxBackups   int
+	eventsFields       []string
+	eventsHashKey      string
+	flowCollector      string
+	flowProtocol       string
+	flowEnterprise     uint32
+	flowDomain         uint32
+	logForwardTarget   string
+	logForwardLevel    string
+	logForwardMaxSize  int64
+	logForwardBackups  int
 
 	logger = promlog.New(&promlog.Config{})
 	cmd    = &cobra.Command{
@@ -225,39 +591,214 @@ func init() {
 	cmd.Flags().StringVar(&listenAddress, "web.listen-address", ":9877", "Address to listen on for web interface and telemetry")
 	cmd.Flags().StringVar(&metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics")
 	cmd.Flags().StringVar(&tlsConfigPath, "web.config.file", "", "[EXPERIMENTAL] Path to configuration file that can enable TLS or authentication")
+	cmd.Flags().StringVar(&configPath, "config.file", "", "Path to configuration file with the modules used by /probe")
 
-	cmd.Flags().StringVar(&externalController, "clash.external-controller", "http://127.0.0.1:9090/", "RESTful web API listening address")
+	cmd.Flags().StringVar(&externalController, "clash.external-controller", "http://127.0.0.1:9090/", "RESTful web API listening address, unix:///path/to/socket for a unix domain socket")
 	cmd.Flags().StringVar(&secret, "clash.secret", "", "Secret for the RESTful API")
+	cmd.Flags().StringVar(&transportConfig.CAFile, "clash.ca-file", "", "CA certificate to verify the RESTful API server")
+	cmd.Flags().StringVar(&transportConfig.CertFile, "clash.cert-file", "", "Client certificate file for the RESTful API")
+	cmd.Flags().StringVar(&transportConfig.KeyFile, "clash.key-file", "", "Client key file for the RESTful API")
+	cmd.Flags().BoolVar(&transportConfig.InsecureSkipVerify, "clash.insecure-skip-verify", false, "Disable verification of the RESTful API server certificate")
+	cmd.Flags().StringToStringVar(&transportConfig.Headers, "clash.header", nil, "Extra header sent to the RESTful API, e.g. X-Forwarded-User=exporter")
 	cmd.Flags().StringVar(&testUrl, "clash.test-url", DefaultTestUrl, "")
 	cmd.Flags().DurationVar(&testUrlTimeout, "clash.test-url-timeout", DefaultTestUrlTimeout, "")
+	cmd.Flags().DurationVar(&probeInterval, "clash.probe-interval", DefaultProbeInterval, "Interval between background proxy delay probes")
+	cmd.Flags().DurationVar(&probeJitter, "clash.probe-jitter", DefaultProbeJitter, "Maximum random delay added to each probe interval")
+	cmd.Flags().StringSliceVar(&proxyIncludeTypes, "clash.proxy-include-type", nil, "Proxy type that is always probed as a leaf proxy")
+	cmd.Flags().StringSliceVar(&proxyExcludeTypes, "clash.proxy-exclude-type", nil, "Proxy type that is never probed")
+	cmd.Flags().StringVar(&proxyExcludeNames, "clash.proxy-exclude-name", "", "Regexp of proxy names that are never probed")
+	cmd.Flags().BoolVar(&connectionTracking, "clash.connection-tracking", false, "Track connections across polls to account traffic by rule, outbound, connection type and inbound")
+	cmd.Flags().DurationVar(&connectionsPoll, "clash.connections-poll-interval", 0, "Interval between polls of connections for traffic accounting, 0 to poll on every scrape")
+	cmd.Flags().BoolVar(&trafficStreams, "clash.traffic-streams", false, "Subscribe the /traffic and /memory streams for real-time traffic and memory gauges")
+	cmd.Flags().DurationVar(&trafficPeakWindow, "clash.traffic-peak-window", DefaultTrafficPeakWindow, "Period over which the peak traffic rate of the /traffic stream is taken")
+	cmd.Flags().StringVar(&logLevel, "clash.log-level", "silent", "Level of the /logs stream to count log messages and dial errors, one of debug, info, warning, error or silent to disable")
+	cmd.Flags().DurationVar(&ruleProviderMaxAge, "clash.rule-provider-max-age", 0, "Update HTTP rule providers older than this, 0 to never update them")
+	cmd.Flags().BoolVar(&connHistograms, "clash.connection-histograms", false, "Observe the duration and bytes of closed connections into histograms")
+	cmd.Flags().Float64SliceVar(&durationBuckets, "clash.connection-duration-buckets", DefaultConnectionDurationBuckets, "Buckets of the connection duration histogram in seconds")
+	cmd.Flags().Float64SliceVar(&bytesBuckets, "clash.connection-bytes-buckets", DefaultConnectionBytesBuckets, "Buckets of the connection bytes histogram")
+	cmd.Flags().Float64Var(&nativeBucketFactor, "clash.native-histogram-bucket-factor", 0, "Growth factor of the buckets of native connection histograms, e.g. 1.1, 0 to only expose classic histograms")
+	cmd.Flags().IntVar(&topDestinations, "clash.top-destinations", 0, "Number of destination hosts with the most bytes that are exported and listed at /destinations, 0 to disable")
+	cmd.Flags().StringVar(&geoipCountryFile, "geoip.country-file", "", "MaxMind country database, e.g. GeoLite2-Country.mmdb or the Country.mmdb of Clash, to account traffic by destination country")
+	cmd.Flags().StringVar(&geoipASNFile, "geoip.asn-file", "", "MaxMind ASN database, e.g. GeoLite2-ASN.mmdb, to account traffic by destination network")
+	cmd.Flags().BoolVar(&processTraffic, "clash.process-traffic", false, "Account traffic by the local process reported by Clash.Meta, whose names are normalized by process_names of --config.file")
+	cmd.Flags().StringVar(&eventsFile, "events.file", "", "File to write a JSON line for every closed connection to, - for stdout")
+	cmd.Flags().Int64Var(&eventsMaxSize, "events.max-size", 100<<20, "Size in bytes at which the events file is rotated")
+	cmd.Flags().IntVar(&eventsMaxBackups, "events.max-backups", 5, "Number of rotated events files to keep")
+	cmd.Flags().StringSliceVar(&eventsFields, "events.fields", ConnectionEventFields, "Fields of the connection events")
+	cmd.Flags().StringVar(&eventsHashKey, "events.source-ip-hash-key", "", "Key to replace source IPs of the connection events with their HMAC-SHA256, empty to keep them")
+	cmd.Flags().StringVar(&flowCollector, "flows.collector", "", "Address of the UDP collector to send closed connections to as flow records, e.g. 127.0.0.1:4739")
+	cmd.Flags().StringVar(&flowProtocol, "flows.protocol", FlowProtocolIPFIX, "Protocol of the flow records, ipfix or netflow9")
+	cmd.Flags().Uint32Var(&flowEnterprise, "flows.enterprise-number", DefaultFlowEnterpriseNumber, "Private enterprise number of the IPFIX fields of the rule, the rule payload, the chain and the host")
+	cmd.Flags().Uint32Var(&flowDomain, "flows.observation-domain", 0, "Observation domain ID, or source ID of NetFlow v9, of the flow records")
+	cmd.Flags().StringVar(&logForwardTarget, "logs.forward-to", "", "Syslog server to forward the Clash logs to as udp://host:port, tcp://host:port or unix:///dev/log, or a file to write them to")
+	cmd.Flags().StringVar(&logForwardLevel, "logs.forward-level", DefaultLogForwardLevel, "Level of the forwarded Clash logs, one of debug, info, warning or error")
+	cmd.Flags().Int64Var(&logForwardMaxSize, "logs.forward-max-size", 100<<20, "Size in bytes at which the file of forwarded logs is rotated")
+	cmd.Flags().IntVar(&logForwardBackups, "logs.forward-max-backups", 5, "Number of rotated files of forwarded logs to keep")
+	cmd.Flags().BoolVar(&trafficTotals, "clash.traffic-totals", false, "Keep the traffic totals monotonic across Clash restarts")
+	cmd.Flags().StringVar(&stateFile, "state.file", "", "File to persist the accumulated traffic totals across exporter restarts, requires --clash.traffic-totals")
+	cmd.Flags().DurationVar(&stateSaveInterval, "state.save-interval", DefaultStateSaveInterval, "Minimum interval between saves of the state file, which is also saved on shutdown")
+	cmd.Flags().BoolVar(&clientTraffic, "clients.traffic", false, "Account the traffic of connections to the LAN devices they come from")
+	cmd.Flags().StringSliceVar(&leaseFiles, "clients.lease-file", nil, "dnsmasq or odhcpd lease file to resolve hostname and MAC of LAN devices")
+	cmd.Flags().StringVar(&staticDevicesFile, "clients.static-file", "", "File of \"<ip> <hostname> [<mac>]\" lines to resolve LAN devices")
+	cmd.Flags().IntVar(&maxDevices, "clients.max-devices", DefaultMaxDevices, "Maximum number of LAN devices with their own traffic metrics, the others are summed up as __other__")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		client, err := NewClient(externalController, secret)
+		if err := checkLogForwardLevel(logForwardLevel); err != nil {
+			return err
+		}
+		client, err := NewClient(externalController, secret, WithTransportConfig(&transportConfig))
 		if err != nil {
 			return err
 		}
-		c, err := NewExporter(client, testUrl, testUrlTimeout)
+		classifier := &ProxyClassifier{IncludeTypes: proxyIncludeTypes, ExcludeTypes: proxyExcludeTypes}
+		if proxyExcludeNames != "" {
+			classifier.ExcludeNames, err = regexp.Compile(proxyExcludeNames)
+			if err != nil {
+				return err
+			}
+		}
+		opts := []ExporterOption{WithProbeInterval(probeInterval, probeJitter), WithProxyClassifier(classifier), WithConnectionsPollInterval(connectionsPoll)}
+		if connectionTracking {
+			opts = append(opts, WithConnectionTracking())
+		}
+		if trafficStreams {
+			opts = append(opts, WithTrafficStreams(trafficPeakWindow))
+		}
+		if logLevel != "silent" {
+			opts = append(opts, WithLogStream(logLevel))
+		}
+		if ruleProviderMaxAge > 0 {
+			opts = append(opts, WithRuleProviderMaxAge(ruleProviderMaxAge))
+		}
+		if stateFile != "" && !trafficTotals {
+			return errors.New("--state.file requires --clash.traffic-totals")
+		}
+		var totals *TrafficTotals
+		if trafficTotals {
+			totals = NewTrafficTotals()
+			if stateFile != "" {
+				if totals, err = LoadTrafficTotals(stateFile, stateSaveInterval); err != nil {
+					return err
+				}
+			}
+			opts = append(opts, WithTrafficTotals(totals))
+		}
+		if connHistograms {
+			opts = append(opts, WithConnectionCollector(NewConnectionHistograms(durationBuckets, bytesBuckets, nativeBucketFactor)))
+		}
+		var top *TopDestinations
+		if topDestinations > 0 {
+			top = NewTopDestinations(topDestinations)
+			opts = append(opts, WithConnectionCollector(top))
+		}
+		if geoipCountryFile != "" || geoipASNFile != "" {
+			var countryDB, asnDB *GeoDatabase
+			if geoipCountryFile != "" {
+				countryDB = NewGeoDatabase(geoipCountryFile)
+			}
+			if geoipASNFile != "" {
+				asnDB = NewGeoDatabase(geoipASNFile)
+			}
+			opts = append(opts, WithConnectionCollector(NewGeoTraffic(countryDB, asnDB)))
+		}
+		if eventsFile != "" {
+			var w io.Writer = os.Stdout
+			if eventsFile != "-" {
+				if w, err = OpenRotatingFile(eventsFile, eventsMaxSize, eventsMaxBackups); err != nil {
+					return err
+				}
+			}
+			events, err := NewConnectionEventLog(w, eventsFields, eventsHashKey)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, WithConnectionCollector(events))
+		}
+		if flowCollector != "" {
+			flows, err := NewFlowExporter(flowCollector, flowProtocol, flowEnterprise, flowDomain)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, WithConnectionCollector(flows))
+		}
+		if logForwardTarget != "" {
+			output, err := NewLogOutput(logForwardTarget, logForwardMaxSize, logForwardBackups)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, WithLogForwarder(NewLogForwarder(output, logForwardLevel)))
+		}
+		if clientTraffic {
+			opts = append(opts, WithConnectionCollector(NewClientTraffic(NewDeviceResolver(leaseFiles, staticDevicesFile), maxDevices)))
+		}
+		var conf *Config
+		if configPath != "" {
+			conf, err = LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+		}
+		if processTraffic {
+			var names []*ProcessName
+			if conf != nil {
+				names = conf.ProcessNames
+			}
+			opts = append(opts, WithConnectionCollector(NewProcessTraffic(names)))
+		}
+		c, err := NewExporter(client, testUrl, testUrlTimeout, opts...)
 		if err != nil {
 			return err
 		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go c.Run(ctx)
+		defaultModule := &Module{TestUrl: testUrl, TestUrlTimeout: testUrlTimeout}
+		if conf != nil && conf.Modules["default"] != nil {
+			defaultModule = conf.Modules["default"]
+		}
 		prometheus.MustRegister(version.NewCollector("clash_exporter"))
+		prometheus.MustRegister(rotationErrors)
 		prometheus.MustRegister(c)
 		level.Info(logger).Log("msg", "Listening on address", "address", listenAddress)
 		http.Handle(metricsPath, promhttp.Handler())
+		if top != nil {
+			http.Handle("/destinations", top)
+		}
+		http.Handle("/probe", ProbeHandler(ctx, conf, defaultModule, WithProbeInterval(probeInterval, probeJitter), WithProxyClassifier(classifier)))
+		links := `<p><a href='` + metricsPath + `'>Metrics</a></p>`
+		if top != nil {
+			links += `
+             <p><a href='/destinations'>Top destinations</a></p>`
+		}
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			_, _ = w.Write([]byte(`<html>
              <head><title>Clash Exporter</title></head>
              <body>
              <h1>Clash Exporter</h1>
-             <p><a href='` + metricsPath + `'>Metrics</a></p>
+             ` + links + `
              </body>
              </html>`))
 		})
 		srv := &http.Server{Addr: listenAddress}
+		go func() {
+			<-ctx.Done()
+			level.Info(logger).Log("msg", "Shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = srv.Shutdown(shutdownCtx)
+		}()
 		err = web.ListenAndServe(srv, tlsConfigPath, logger)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
 		if err != nil {
 			level.Error(logger).Log("msg", "Error starting HTTP server", "err", err)
 		}
+		if totals != nil {
+			if err := totals.Save(); err != nil {
+				level.Error(logger).Log("msg", "error when save traffic totals", "file", stateFile, "err", err)
+			}
+		}
 		return err
 	}
 }
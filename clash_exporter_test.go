@@ -1,21 +1,44 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 )
 
+// nondeterministicMetrics are excluded from fixture comparison.
+var nondeterministicMetrics = map[string]bool{
+	"clash_scrape_collector_duration_seconds":        true,
+	"clash_proxy_delay_last_probe_timestamp_seconds": true,
+}
+
 func expectMetrics(t *testing.T, c prometheus.Collector, fixture string) {
 	exp, err := os.Open(path.Join("test", fixture))
 	if err != nil {
 		t.Fatalf("Error opening fixture file %q: %v", fixture, err)
 	}
-	if err := testutil.CollectAndCompare(c, exp); err != nil {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := reg.Gather()
+		rv := mfs[:0]
+		for _, mf := range mfs {
+			if !nondeterministicMetrics[mf.GetName()] {
+				rv = append(rv, mf)
+			}
+		}
+		return rv, err
+	})
+	if err := testutil.GatherAndCompare(g, exp); err != nil {
 		t.Fatal("Unexpected metrics returned:", err)
 	}
 }
@@ -54,6 +77,7 @@ func (c *testClient) GetProxies() (map[string]*Proxy, error) {
 	for _, p := range c.makeProxies("proxy_%s") {
 		proxies[p.Name] = p
 	}
+	proxies["Proxy"] = &Proxy{Type: "Selector", Name: "Proxy", Now: "proxy_Vmess", All: []string{"proxy_Vmess", "proxy_Trojan"}}
 	return proxies, nil
 }
 
@@ -67,8 +91,14 @@ func (c *testClient) GetProvidersProxies() (map[string]*Provider, error) {
 			Type:        "Proxy",
 			Name:        "provider_1",
 			VehicleType: VehicleTypeHTTP,
-			UpdatedAt:   time.Time{},
+			UpdatedAt:   time.Unix(1618000000, 0),
 			Proxies:     c.makeProxies("provider_1_proxy_%s"),
+			SubscriptionInfo: &SubscriptionInfo{
+				Upload:   1073741824,
+				Download: 10737418240,
+				Total:    107374182400,
+				Expire:   1640966400,
+			},
 		},
 		"provider_2": {
 			Type:        "Proxy",
@@ -94,15 +124,200 @@ func (c *testClient) GetConnections() (*Snapshot, error) {
 	return &Snapshot{
 		DownloadTotal: 111,
 		UploadTotal:   222,
-		Connections:   nil,
+		Connections: []*TrackerInfo{
+			newTrackerInfo("6a5b6c34", 12, 34, "DomainSuffix", "google.com", "proxy_Vmess", "Proxy"),
+			newTrackerInfo("9f0e1d2c", 56, 78, "Match", "", "DIRECT"),
+		},
+	}, nil
+}
+
+func (c *testClient) GetRules() ([]*Rule, error) {
+	return []*Rule{
+		{Type: "DomainSuffix", Payload: "google.com", Proxy: "Proxy"},
+		{Type: "DomainSuffix", Payload: "youtube.com", Proxy: "Proxy"},
+		{Type: "RuleSet", Payload: "reject", Proxy: "REJECT"},
+		{Type: "GeoIP", Payload: "CN", Proxy: "DIRECT"},
+		{Type: "Match", Payload: "", Proxy: "Proxy"},
+	}, nil
+}
+
+func (c *testClient) GetProvidersRules() (map[string]*RuleProvider, error) {
+	return map[string]*RuleProvider{
+		"geosite": {
+			Name:        "geosite",
+			Type:        "Rule",
+			Behavior:    "Domain",
+			VehicleType: VehicleTypeHTTP,
+			RuleCount:   12345,
+			UpdatedAt:   time.Unix(1618000000, 0),
+		},
+		"lan": {
+			Name:        "lan",
+			Type:        "Rule",
+			Behavior:    "IPCIDR",
+			VehicleType: VehicleTypeFile,
+			RuleCount:   8,
+			UpdatedAt:   time.Unix(1618000000, 0),
+		},
+	}, nil
+}
+
+func (c *testClient) UpdateRuleProvider(providerName string) error {
+	return nil
+}
+
+func (c *testClient) GetConfigs() (*Configs, error) {
+	return &Configs{
+		Port:        7890,
+		SocksPort:   7891,
+		MixedPort:   7892,
+		AllowLan:    true,
+		BindAddress: "*",
+		Mode:        "rule",
+		LogLevel:    "info",
+		Tun:         &Tun{Enable: true},
 	}, nil
 }
 
+func (c *testClient) IsUnauthenticated() (bool, error) {
+	return true, nil
+}
+
+func (c *testClient) ControllerUrl() *url.URL {
+	u, _ := url.Parse("http://192.168.1.1:9090")
+	return u
+}
+
+func (c *testClient) Stream(ctx context.Context, u *url.URL, fn func(data []byte) error) error {
+	switch u.Path {
+	case "/traffic":
+		return fn([]byte(`{"up":1024,"down":4096}`))
+	case "/memory":
+		return fn([]byte(`{"inuse":33554432,"oslimit":0}`))
+	}
+	return errors.New("unknown stream")
+}
+
+var errUnavailable = errors.New("connection refused")
+
+type unavailableClient struct {
+}
+
+func (c *unavailableClient) GetVersion() (*Version, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) GetProxies() (map[string]*Proxy, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) GetProxyDelay(proxyName string, testUrl string, timeout time.Duration) (uint16, error) {
+	return 0, errUnavailable
+}
+
+func (c *unavailableClient) GetProvidersProxies() (map[string]*Provider, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) ProviderProxiesHealthCheck(providerName string) error {
+	return errUnavailable
+}
+
+func (c *unavailableClient) GetConnections() (*Snapshot, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) GetRules() ([]*Rule, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) GetProvidersRules() (map[string]*RuleProvider, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) UpdateRuleProvider(providerName string) error {
+	return errUnavailable
+}
+
+func (c *unavailableClient) GetConfigs() (*Configs, error) {
+	return nil, errUnavailable
+}
+
+func (c *unavailableClient) IsUnauthenticated() (bool, error) {
+	return false, errUnavailable
+}
+
+func (c *unavailableClient) ControllerUrl() *url.URL {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	return u
+}
+
+func (c *unavailableClient) Stream(ctx context.Context, u *url.URL, fn func(data []byte) error) error {
+	return errUnavailable
+}
+
+func TestExporterUnavailable(t *testing.T) {
+	e, err := NewExporter(&unavailableClient{}, DefaultTestUrl, DefaultTestUrlTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.prober.Probe()
+	expectMetrics(t, e, "unavailable.metrics")
+}
+
+// outageClient forwards to the embedded client, which is replaced to take Clash down.
+type outageClient struct {
+	IClient
+}
+
+func TestExporterOutageAfterProbe(t *testing.T) {
+	client := &outageClient{IClient: &testClient{}}
+	e, err := NewExporter(client, DefaultTestUrl, DefaultTestUrlTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.prober.Probe()
+	client.IClient = &unavailableClient{}
+	expected := `
+# HELP clash_up Was the last scrape of Clash successful, i.e. did at least one collector get an answer.
+# TYPE clash_up gauge
+clash_up 0
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "clash_up"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wrongSecretClient rejects the secret of the exporter, but Clash answers without one.
+type wrongSecretClient struct {
+	unavailableClient
+}
+
+func (c *wrongSecretClient) IsUnauthenticated() (bool, error) {
+	return true, nil
+}
+
+func TestExporterWrongSecret(t *testing.T) {
+	e, err := NewExporter(&wrongSecretClient{}, DefaultTestUrl, DefaultTestUrlTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP clash_up Was the last scrape of Clash successful, i.e. did at least one collector get an answer.
+# TYPE clash_up gauge
+clash_up 0
+`
+	if err := testutil.CollectAndCompare(e, strings.NewReader(expected), "clash_up"); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestExporter(t *testing.T) {
-	e, err := NewExporter(&testClient{}, DefaultTestUrl, DefaultTestUrlTimeout)
+	e, err := NewExporter(&testClient{}, DefaultTestUrl, DefaultTestUrlTimeout, WithConnectionTracking())
 	if err != nil {
 		t.Fatal(err)
 	}
+	e.prober.Probe()
 	t.Run("expect test metrics", func(t *testing.T) {
 		expectMetrics(t, e, "normal.metrics")
 	})
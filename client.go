@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/go-kit/kit/log/level"
 	"io"
+	"net"
 	"net/url"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -19,6 +24,13 @@ type IClient interface {
 	GetProvidersProxies() (map[string]*Provider, error)
 	ProviderProxiesHealthCheck(providerName string) error
 	GetConnections() (*Snapshot, error)
+	GetRules() ([]*Rule, error)
+	GetProvidersRules() (map[string]*RuleProvider, error)
+	GetConfigs() (*Configs, error)
+	IsUnauthenticated() (bool, error)
+	ControllerUrl() *url.URL
+	UpdateRuleProvider(providerName string) error
+	Stream(ctx context.Context, u *url.URL, fn func(data []byte) error) error
 }
 
 const (
@@ -32,40 +44,156 @@ var (
 	providersProxiesUrl, _ = url.Parse("/providers/proxies")
 	connectionsUrl, _      = url.Parse("/connections")
 	versionUrl, _          = url.Parse("/version")
+	rulesUrl, _            = url.Parse("/rules")
+	providersRulesUrl, _   = url.Parse("/providers/rules")
+	configsUrl, _          = url.Parse("/configs")
+	trafficUrl, _          = url.Parse("/traffic")
+	memoryUrl, _           = url.Parse("/memory")
 )
 
+// StatusError is returned when the external controller answers with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Path       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %q from %s", e.Status, e.Path)
+}
+
 type Client struct {
 	BaseUrl *url.URL
-	Secret  string
-	client  *http.Client
+	// Controller is the external controller as configured, i.e. unix:// for unix domain sockets.
+	Controller *url.URL
+	Secret     string
+	Headers    http.Header
+	client     *http.Client
+	// stream is client without timeout for long-lived streams.
+	stream *http.Client
+}
+
+// TransportConfig configures how the Client reaches the external controller.
+type TransportConfig struct {
+	CAFile             string            `yaml:"ca_file"`
+	CertFile           string            `yaml:"cert_file"`
+	KeyFile            string            `yaml:"key_file"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	Headers            map[string]string `yaml:"headers"`
+}
+
+type ClientOption func(c *Client, transport *http.Transport) error
+
+// WithTransportConfig sets up TLS and static headers of the Client from conf.
+func WithTransportConfig(conf *TransportConfig) ClientOption {
+	return func(c *Client, transport *http.Transport) error {
+		for k, v := range conf.Headers {
+			c.Headers.Set(k, v)
+		}
+		tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+		if conf.CAFile != "" {
+			data, err := os.ReadFile(conf.CAFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("no certificate found in CA file %q", conf.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if conf.CertFile != "" || conf.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+		return nil
+	}
 }
 
-func NewClient(baseUrl string, secret string) (*Client, error) {
+// NewClient returns a Client of the external controller at baseUrl.
+// Besides http and https, baseUrl can be unix:///path/to/controller.sock
+// to reach the controller listening on a unix domain socket.
+func NewClient(baseUrl string, secret string, opts ...ClientOption) (*Client, error) {
 	u, err := url.Parse(baseUrl)
 	if err != nil {
 		return nil, err
 	}
-	c := &http.Client{
-		Timeout: DefaultClientTimeout,
+	controller := u
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "http", "https":
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		u = &url.URL{Scheme: "http", Host: "unix"}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q of external controller %q", u.Scheme, baseUrl)
+	}
+	c := &Client{
+		BaseUrl:    u,
+		Controller: controller,
+		Secret:     secret,
+		Headers:    make(http.Header),
+		client: &http.Client{
+			Timeout:   DefaultClientTimeout,
+			Transport: transport,
+		},
+		stream: &http.Client{
+			Transport: transport,
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(c, transport); err != nil {
+			return nil, err
+		}
 	}
-	return &Client{
-		BaseUrl: u,
-		Secret:  secret,
-		client:  c,
-	}, nil
+	return c, nil
 }
 
-func (c *Client) request(u *url.URL, v interface{}) error {
+// do sends a request to the external controller and checks the response status.
+func (c *Client) do(ctx context.Context, client *http.Client, method string, u *url.URL) (*http.Response, error) {
 	u = c.BaseUrl.ResolveReference(u)
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for k, v := range c.Headers {
+		req.Header[k] = v
+	}
+	if c.Secret != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Secret))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_ = resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Path: u.Path}
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Secret))
-	resp, err := c.client.Do(req)
-	if err != nil || v == nil {
+	return resp, nil
+}
+
+func (c *Client) request(u *url.URL, v interface{}) error {
+	return c.requestWithMethod(http.MethodGet, u, v)
+}
+
+func (c *Client) requestWithMethod(method string, u *url.URL, v interface{}) error {
+	resp, err := c.do(context.Background(), c.client, method, u)
+	if err != nil {
 		return err
 	}
+	defer func() { _ = resp.Body.Close() }()
+	if v == nil {
+		return nil
+	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -81,9 +209,7 @@ func (c *Client) request(u *url.URL, v interface{}) error {
 	//}
 	//fmt.Println(buf.String())
 
-	_ = resp.Body.Close()
-	err = json.Unmarshal(data, v)
-	return err
+	return json.Unmarshal(data, v)
 }
 
 func (c *Client) GetVersion() (*Version, error) {
@@ -142,6 +268,78 @@ func (c *Client) GetConnections() (*Snapshot, error) {
 	return container, nil
 }
 
+func (c *Client) GetRules() ([]*Rule, error) {
+	container := make(map[string][]*Rule)
+	if err := c.request(rulesUrl, &container); err != nil {
+		return nil, err
+	}
+	return container["rules"], nil
+}
+
+func (c *Client) GetProvidersRules() (map[string]*RuleProvider, error) {
+	container := make(map[string]map[string]*RuleProvider)
+	if err := c.request(providersRulesUrl, &container); err != nil {
+		return nil, err
+	}
+	return container["providers"], nil
+}
+
+// UpdateRuleProvider makes Clash fetch the rule provider again.
+func (c *Client) UpdateRuleProvider(providerName string) error {
+	return c.requestWithMethod(http.MethodPut, &url.URL{Path: "/providers/rules/" + providerName}, nil)
+}
+
+func (c *Client) GetConfigs() (*Configs, error) {
+	var raw json.RawMessage
+	if err := c.request(configsUrl, &raw); err != nil {
+		return nil, err
+	}
+	container := new(Configs)
+	if err := json.Unmarshal(raw, container); err != nil {
+		return nil, err
+	}
+	container.Raw = raw
+	return container, nil
+}
+
+// IsUnauthenticated reports whether the external controller answers requests without the secret.
+func (c *Client) IsUnauthenticated() (bool, error) {
+	anonymous := *c
+	anonymous.Secret = ""
+	err := anonymous.request(versionUrl, new(Version))
+	if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusUnauthorized {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *Client) ControllerUrl() *url.URL {
+	return c.Controller
+}
+
+// Stream calls fn with each JSON object that Clash streams on u, e.g. /traffic,
+// until ctx is done, the stream ends or fn returns an error.
+func (c *Client) Stream(ctx context.Context, u *url.URL, fn func(data []byte) error) error {
+	resp, err := c.do(ctx, c.stream, http.MethodGet, u)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var data json.RawMessage
+		if err := dec.Decode(&data); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
 func GetAllProxyDelay(proxies map[string]*Proxy, filter func(*Proxy) bool, client IClient, testUrl string, testUrlTimeout time.Duration) map[string]uint16 {
 	if filter == nil {
 		filter = func(*Proxy) bool {
@@ -1,11 +1,47 @@
 package main
 
 import (
+	"encoding/pem"
 	"github.com/davecgh/go-spew/spew"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
+// newFakeClash starts a server that answers like a Clash external controller protected by secret.
+func newFakeClash(t *testing.T, secret string) *httptest.Server {
+	responses := map[string]string{
+		"/version":           `{"premium":false,"version":"v1.6.0"}`,
+		"/proxies":           `{"proxies":{"GLOBAL":{"type":"Selector","name":"GLOBAL","now":"HK","all":["HK"],"history":[]},"HK":{"type":"Shadowsocks","name":"HK","history":[]}}}`,
+		"/proxies/HK/delay":  `{"delay":120}`,
+		"/providers/proxies": `{"providers":{}}`,
+		"/providers/rules":   `{"providers":{}}`,
+		"/rules":             `{"rules":[{"type":"DomainSuffix","payload":"google.com","proxy":"GLOBAL"},{"type":"Match","payload":"","proxy":"DIRECT"}]}`,
+		"/configs":           `{"port":7890,"socks-port":7891,"mixed-port":0,"allow-lan":false,"bind-address":"*","mode":"rule","log-level":"info","ipv6":false}`,
+		"/connections":       `{"downloadTotal":1024,"uploadTotal":512,"connections":[]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret != "" && r.Header.Get("Authorization") != "Bearer "+secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"Unauthorized"}`))
+			return
+		}
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"Resource not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 func TestClient(t *testing.T) {
 	// TODO: mock response
 	baseUrl := os.Getenv("CLASH_EXTERNAL_CONTROLLER")
@@ -62,4 +98,91 @@ func TestClient(t *testing.T) {
 			t.Errorf("GetConnections failed because of error = %v, rv = %v", err, spew.Sprint(connections))
 		}
 	})
+
+	t.Run("GetProvidersRules", func(t *testing.T) {
+		t.Parallel()
+		providers, err := client.GetProvidersRules()
+		if err != nil {
+			t.Errorf("GetProvidersRules failed because of error = %v, rv = %v", err, spew.Sprint(providers))
+		}
+	})
+
+	t.Run("GetConfigs", func(t *testing.T) {
+		t.Parallel()
+		configs, err := client.GetConfigs()
+		if err != nil || configs.Mode == "" {
+			t.Errorf("GetConfigs failed because of error = %v, rv = %v", err, spew.Sprint(configs))
+		}
+	})
+
+	t.Run("GetRules", func(t *testing.T) {
+		t.Parallel()
+		rules, err := client.GetRules()
+		if err != nil || len(rules) == 0 {
+			t.Errorf("GetRules failed because of error = %v, rv = %v", err, spew.Sprint(rules))
+		}
+	})
+}
+
+func TestClientTransport(t *testing.T) {
+	versionHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-User") != "exporter" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"premium":true,"version":"2021.04.08"}`))
+	})
+	headers := &TransportConfig{Headers: map[string]string{"X-Forwarded-User": "exporter"}}
+
+	t.Run("unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "controller.sock")
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Skip("unix domain socket is not supported:", err)
+		}
+		srv := httptest.NewUnstartedServer(versionHandler)
+		srv.Listener = l
+		srv.Start()
+		defer srv.Close()
+
+		client, err := NewClient("unix://"+socket, "", WithTransportConfig(headers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := client.GetVersion(); err != nil || v.Version != "2021.04.08" {
+			t.Errorf("GetVersion failed because of error = %v, rv = %v", err, spew.Sprint(v))
+		}
+	})
+
+	t.Run("https with custom CA", func(t *testing.T) {
+		srv := httptest.NewTLSServer(versionHandler)
+		defer srv.Close()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewClient(srv.URL, "", WithTransportConfig(headers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.GetVersion(); err == nil {
+			t.Error("expected an error when the server certificate is not trusted")
+		}
+
+		client, err = NewClient(srv.URL, "", WithTransportConfig(&TransportConfig{CAFile: caFile, Headers: headers.Headers}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := client.GetVersion(); err != nil || v.Version != "2021.04.08" {
+			t.Errorf("GetVersion failed because of error = %v, rv = %v", err, spew.Sprint(v))
+		}
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		if _, err := NewClient("ftp://127.0.0.1:9090", ""); err == nil {
+			t.Error("expected an error for unsupported scheme")
+		}
+	})
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultMaxDevices = 256
+	// otherDevices collects the traffic of devices beyond the maximum number of tracked devices.
+	otherDevices = otherLabel
+)
+
+var (
+	clientDownloadBytes = prometheus.NewDesc(prometheus.BuildFQName(namespace, "client", "download_bytes_total"), "Number of bytes downloaded by the LAN device.", []string{"source_ip", "hostname", "mac"}, nil)
+	clientUploadBytes   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "client", "upload_bytes_total"), "Number of bytes uploaded by the LAN device.", []string{"source_ip", "hostname", "mac"}, nil)
+)
+
+// Device is a LAN device known from a lease or static mapping file.
+type Device struct {
+	Hostname string
+	MAC      string
+}
+
+// ParseLeases parses a dnsmasq or odhcpd lease file into devices by IP.
+func ParseLeases(r io.Reader) (map[string]*Device, error) {
+	devices := make(map[string]*Device)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 9 && fields[0] == "#" {
+			// odhcpd: # <interface> <duid> <iaid> <hostname> <valid until> <id> <prefix length> <address/length>...
+			d := &Device{Hostname: fields[4], MAC: macFromDUID(fields[2])}
+			if d.Hostname == "-" {
+				d.Hostname = ""
+			}
+			for _, addr := range fields[8:] {
+				devices[strings.SplitN(addr, "/", 2)[0]] = d
+			}
+		} else if len(fields) >= 4 && !strings.HasPrefix(fields[0], "#") {
+			// dnsmasq: <expiry> <mac or iaid> <ip> <hostname> [<client id>]
+			d := &Device{Hostname: fields[3]}
+			if d.Hostname == "*" {
+				d.Hostname = ""
+			}
+			if mac, err := net.ParseMAC(fields[1]); err == nil {
+				d.MAC = mac.String()
+			}
+			devices[fields[2]] = d
+		}
+	}
+	return devices, scanner.Err()
+}
+
+// ParseStaticDevices parses lines of "<ip> <hostname> [<mac>]", lines starting with # are ignored.
+func ParseStaticDevices(r io.Reader) (map[string]*Device, error) {
+	devices := make(map[string]*Device)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		d := &Device{Hostname: fields[1]}
+		if len(fields) >= 3 {
+			if mac, err := net.ParseMAC(fields[2]); err == nil {
+				d.MAC = mac.String()
+			}
+		}
+		devices[fields[0]] = d
+	}
+	return devices, scanner.Err()
+}
+
+// macFromDUID extracts the MAC address of a bare hex MAC, a DUID-LLT or a DUID-LL of ethernet.
+func macFromDUID(duid string) string {
+	b, err := hex.DecodeString(duid)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case len(b) == 6:
+	case len(b) == 14 && b[0] == 0 && b[1] == 1 && b[2] == 0 && b[3] == 1:
+		b = b[8:]
+	case len(b) == 10 && b[0] == 0 && b[1] == 3 && b[2] == 0 && b[3] == 1:
+		b = b[4:]
+	default:
+		return ""
+	}
+	return net.HardwareAddr(b).String()
+}
+
+// DeviceResolver resolves IPs to devices from lease files and a static mapping file,
+// reloading them when they change. Fields of static mappings take precedence over leases.
+type DeviceResolver struct {
+	leaseFiles []string
+	staticFile string
+
+	mutex   sync.Mutex
+	files   map[string]os.FileInfo
+	devices map[string]*Device
+}
+
+func NewDeviceResolver(leaseFiles []string, staticFile string) *DeviceResolver {
+	return &DeviceResolver{
+		leaseFiles: leaseFiles,
+		staticFile: staticFile,
+		files:      make(map[string]os.FileInfo),
+		devices:    make(map[string]*Device),
+	}
+}
+
+// Resolve returns the device of ip, or an empty device if it is unknown.
+func (r *DeviceResolver) Resolve(ip string) *Device {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if d, ok := r.devices[ip]; ok {
+		return d
+	}
+	return &Device{}
+}
+
+// Refresh reloads the files if any of them changed, was replaced or was removed.
+func (r *DeviceResolver) Refresh() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	changed := false
+	files := append(append([]string{}, r.leaseFiles...), r.staticFile)
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		prev, loaded := r.files[name]
+		fi, err := os.Stat(name)
+		if err != nil {
+			if loaded {
+				delete(r.files, name)
+				changed = true
+			}
+			continue
+		}
+		if !loaded || fileChanged(prev, fi) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	devices := make(map[string]*Device)
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		parse := ParseLeases
+		if name == r.staticFile {
+			parse = ParseStaticDevices
+		}
+		loaded, err := r.load(name, parse)
+		if err != nil {
+			level.Warn(logger).Log("msg", "error when load devices", "file", name, "err", err)
+			continue
+		}
+		for ip, d := range loaded {
+			if prev, ok := devices[ip]; ok {
+				merged := *prev
+				if d.Hostname != "" {
+					merged.Hostname = d.Hostname
+				}
+				if d.MAC != "" {
+					merged.MAC = d.MAC
+				}
+				d = &merged
+			}
+			devices[ip] = d
+		}
+	}
+	r.devices = devices
+}
+
+// fileChanged reports whether fi is another file than prev, e.g. after it was replaced, or was modified since prev.
+func fileChanged(prev, fi os.FileInfo) bool {
+	return !os.SameFile(prev, fi) || !fi.ModTime().Equal(prev.ModTime()) || fi.Size() != prev.Size()
+}
+
+func (r *DeviceResolver) load(name string, parse func(io.Reader) (map[string]*Device, error)) (map[string]*Device, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r.files[name] = fi
+	return parse(f)
+}
+
+// clientKey is the labels of a device. They are resolved when the bytes are recorded, so that the bytes
+// of a device stay with the hostname and MAC it had then instead of moving when its lease changes.
+type clientKey struct {
+	ip string
+	Device
+}
+
+// ClientTraffic accounts connection deltas to the LAN device by source IP.
+type ClientTraffic struct {
+	resolver   *DeviceResolver
+	maxDevices int
+
+	mutex   sync.Mutex
+	devices map[clientKey]*byteCounter
+}
+
+func NewClientTraffic(resolver *DeviceResolver, maxDevices int) *ClientTraffic {
+	return &ClientTraffic{
+		resolver:   resolver,
+		maxDevices: maxDevices,
+		devices:    make(map[clientKey]*byteCounter),
+	}
+}
+
+func (c *ClientTraffic) ObserveConnections(deltas []*ConnectionDelta) {
+	c.resolver.Refresh()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	other := clientKey{ip: otherDevices}
+	for _, d := range deltas {
+		if (d.Upload == 0 && d.Download == 0) || d.Metadata == nil || d.Metadata.SrcIP == nil {
+			continue
+		}
+		ip := d.Metadata.SrcIP.String()
+		k := clientKey{ip: ip, Device: *c.resolver.Resolve(ip)}
+		counter, ok := c.devices[k]
+		if !ok {
+			tracked := len(c.devices)
+			if _, ok := c.devices[other]; ok {
+				tracked--
+			}
+			if tracked >= c.maxDevices {
+				k = other
+				counter = c.devices[k]
+			}
+			if counter == nil {
+				counter = &byteCounter{}
+				c.devices[k] = counter
+			}
+		}
+		counter.add(d)
+	}
+}
+
+func (c *ClientTraffic) Describe(descs chan<- *prometheus.Desc) {
+	descs <- clientDownloadBytes
+	descs <- clientUploadBytes
+}
+
+func (c *ClientTraffic) Collect(metrics chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, counter := range c.devices {
+		metrics <- prometheus.MustNewConstMetric(clientDownloadBytes, prometheus.CounterValue, float64(counter.Download), k.ip, k.Hostname, k.MAC)
+		metrics <- prometheus.MustNewConstMetric(clientUploadBytes, prometheus.CounterValue, float64(counter.Upload), k.ip, k.Hostname, k.MAC)
+	}
+}
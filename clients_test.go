@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLeases(t *testing.T) {
+	leases := `1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop 01:aa:bb:cc:dd:ee:01
+1700000000 aa:bb:cc:dd:ee:02 192.168.1.11 * *
+duid 00:01:00:01:2c:5e:4f:3a:aa:bb:cc:dd:ee:03
+1700000000 1234567 fd00::11 phone 00:01:00:01:2c:5e:4f:3a:aa:bb:cc:dd:ee:03
+# br-lan 000100012c5e4f3aaabbccddee04 1234 tablet 1700000000 4a3 128 fd00::12/128 fd00::13/128
+# br-lan aabbccddee05 0 tv 1700000000 5 32 192.168.1.12/24
+`
+	devices, err := ParseLeases(strings.NewReader(leases))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]Device{
+		"192.168.1.10": {Hostname: "laptop", MAC: "aa:bb:cc:dd:ee:01"},
+		"192.168.1.11": {MAC: "aa:bb:cc:dd:ee:02"},
+		"fd00::11":     {Hostname: "phone"},
+		"fd00::12":     {Hostname: "tablet", MAC: "aa:bb:cc:dd:ee:04"},
+		"fd00::13":     {Hostname: "tablet", MAC: "aa:bb:cc:dd:ee:04"},
+		"192.168.1.12": {Hostname: "tv", MAC: "aa:bb:cc:dd:ee:05"},
+	} {
+		d := devices[ip]
+		if d == nil || *d != expected {
+			t.Errorf("device of %s = %+v, want %+v", ip, d, expected)
+		}
+	}
+}
+
+func TestClientTraffic(t *testing.T) {
+	dir := t.TempDir()
+	leaseFile := filepath.Join(dir, "dhcp.leases")
+	staticFile := filepath.Join(dir, "devices")
+	if err := os.WriteFile(leaseFile, []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n1700000000 aa:bb:cc:dd:ee:02 192.168.1.11 * *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staticFile, []byte("# ip hostname mac\n192.168.1.11 nas\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientTraffic(NewDeviceResolver([]string{leaseFile}, staticFile), 2)
+	delta := func(srcIP string, download int64) *ConnectionDelta {
+		info := newTrackerInfo(srcIP, 0, download, "Match", "", "DIRECT")
+		info.Metadata.SrcIP = net.ParseIP(srcIP)
+		return &ConnectionDelta{TrackerInfo: info, Download: download}
+	}
+	c.ObserveConnections([]*ConnectionDelta{delta("192.168.1.10", 100), delta("192.168.1.11", 200), delta("192.168.1.10", 1)})
+	c.ObserveConnections([]*ConnectionDelta{delta("192.168.1.12", 300), delta("192.168.1.13", 400)})
+
+	expected := `
+# HELP clash_client_download_bytes_total Number of bytes downloaded by the LAN device.
+# TYPE clash_client_download_bytes_total counter
+clash_client_download_bytes_total{hostname="",mac="",source_ip="__other__"} 700
+clash_client_download_bytes_total{hostname="laptop",mac="aa:bb:cc:dd:ee:01",source_ip="192.168.1.10"} 101
+clash_client_download_bytes_total{hostname="nas",mac="aa:bb:cc:dd:ee:02",source_ip="192.168.1.11"} 200
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "clash_client_download_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceResolverRecreatedFile(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dhcp.leases")
+	write := func(data string) {
+		if err := os.WriteFile(leaseFile, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Keep the modification time, as a copy preserving it would.
+		mtime := time.Unix(1700000000, 0)
+		if err := os.Chtimes(leaseFile, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n")
+	r := NewDeviceResolver([]string{leaseFile}, "")
+	r.Refresh()
+	if d := r.Resolve("192.168.1.10"); d.Hostname != "laptop" {
+		t.Fatalf("unexpected device %+v", d)
+	}
+
+	if err := os.Remove(leaseFile); err != nil {
+		t.Fatal(err)
+	}
+	r.Refresh()
+	if d := r.Resolve("192.168.1.10"); d.Hostname != "" {
+		t.Errorf("expected device of removed lease file to be gone, got %+v", d)
+	}
+
+	write("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 desktop *\n")
+	r.Refresh()
+	if d := r.Resolve("192.168.1.10"); d.Hostname != "desktop" {
+		t.Errorf("expected recreated lease file to be loaded, got %+v", d)
+	}
+}
+
+func TestClientTrafficLeaseChange(t *testing.T) {
+	leaseFile := filepath.Join(t.TempDir(), "dhcp.leases")
+	if err := os.WriteFile(leaseFile, []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.1.10 laptop *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClientTraffic(NewDeviceResolver([]string{leaseFile}, ""), DefaultMaxDevices)
+	delta := func(download int64) *ConnectionDelta {
+		info := newTrackerInfo("192.168.1.10", 0, download, "Match", "", "DIRECT")
+		info.Metadata.SrcIP = net.ParseIP("192.168.1.10")
+		return &ConnectionDelta{TrackerInfo: info, Download: download}
+	}
+	c.ObserveConnections([]*ConnectionDelta{delta(100)})
+	if err := os.WriteFile(leaseFile, []byte("1700000600 aa:bb:cc:dd:ee:03 192.168.1.10 phone *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c.ObserveConnections([]*ConnectionDelta{delta(50)})
+
+	// The bytes of the laptop stay with it after its address was leased to the phone.
+	expected := `
+# HELP clash_client_download_bytes_total Number of bytes downloaded by the LAN device.
+# TYPE clash_client_download_bytes_total counter
+clash_client_download_bytes_total{hostname="laptop",mac="aa:bb:cc:dd:ee:01",source_ip="192.168.1.10"} 100
+clash_client_download_bytes_total{hostname="phone",mac="aa:bb:cc:dd:ee:03",source_ip="192.168.1.10"} 50
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "clash_client_download_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Module holds the per-target settings used by the /probe endpoint.
+type Module struct {
+	Secret         string        `yaml:"secret"`
+	TestUrl        string        `yaml:"test_url"`
+	TestUrlTimeout time.Duration `yaml:"test_url_timeout"`
+	// Targets are the regexes of the target URLs the module may probe. Without them, nothing is probed,
+	// since the secret and the credentials of the module are sent to the target.
+	Targets []string `yaml:"targets"`
+
+	TransportConfig `yaml:",inline"`
+
+	targets []*regexp.Regexp
+}
+
+func (m *Module) compile() error {
+	m.targets = make([]*regexp.Regexp, 0, len(m.Targets))
+	for _, target := range m.Targets {
+		re, err := regexp.Compile("^(?:" + target + ")$")
+		if err != nil {
+			return fmt.Errorf("error parsing target regex %q: %w", target, err)
+		}
+		m.targets = append(m.targets, re)
+	}
+	return nil
+}
+
+// AllowsTarget reports whether target matches one of the targets of the module.
+func (m *Module) AllowsTarget(target string) bool {
+	for _, re := range m.targets {
+		if re.MatchString(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is the content of the file passed with --config.file.
+type Config struct {
+	Modules map[string]*Module `yaml:"modules"`
+	// ProcessNames normalizes the names of local processes, the first matching one applies.
+	ProcessNames []*ProcessName `yaml:"process_names"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		return nil, fmt.Errorf("error parsing config file %q: %w", path, err)
+	}
+	for name, m := range conf.Modules {
+		if m == nil {
+			m = &Module{}
+			conf.Modules[name] = m
+		}
+		if m.TestUrl == "" {
+			m.TestUrl = DefaultTestUrl
+		}
+		if m.TestUrlTimeout == 0 {
+			m.TestUrlTimeout = DefaultTestUrlTimeout
+		}
+		if err := m.compile(); err != nil {
+			return nil, fmt.Errorf("error parsing module %q: %w", name, err)
+		}
+	}
+	for _, p := range conf.ProcessNames {
+		if err := p.compile(); err != nil {
+			return nil, fmt.Errorf("error parsing process name regex %q: %w", p.Regex, err)
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"sync"
+)
+
+var (
+	configInfo    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "config", "info"), "Running configuration of Clash.", []string{"mode", "log_level", "ipv6", "allow_lan", "bind_address"}, nil)
+	configPort    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "config", "port"), "Port of the inbound listener.", []string{"kind"}, nil)
+	tunEnabled    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "tun", "enabled"), "Whether TUN mode is enabled.", nil, nil)
+	configChanges = prometheus.NewDesc(prometheus.BuildFQName(namespace, "config", "changes_total"), "Number of times the running configuration changed between polls.", nil, nil)
+)
+
+// Hash returns a digest of the configs that does not depend on the order of keys.
+func (c *Configs) Hash() ([32]byte, error) {
+	raw := []byte(c.Raw)
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(c); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return [32]byte{}, err
+	}
+	// maps are marshaled with sorted keys
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(canonical), nil
+}
+
+// ConfigTracker exports the running configuration and counts its changes.
+type ConfigTracker struct {
+	mutex   sync.Mutex
+	configs *Configs
+	hash    *[32]byte
+	changes int
+}
+
+func NewConfigTracker() *ConfigTracker {
+	return &ConfigTracker{}
+}
+
+func (t *ConfigTracker) Update(c *Configs) error {
+	hash, err := c.Hash()
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.hash != nil && *t.hash != hash {
+		t.changes++
+	}
+	t.hash = &hash
+	t.configs = c
+	return nil
+}
+
+func (t *ConfigTracker) Describe(descs chan<- *prometheus.Desc) {
+	descs <- configInfo
+	descs <- configPort
+	descs <- tunEnabled
+	descs <- configChanges
+}
+
+func (t *ConfigTracker) Collect(metrics chan<- prometheus.Metric) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c := t.configs
+	if c == nil {
+		return
+	}
+	metrics <- prometheus.MustNewConstMetric(configInfo, prometheus.GaugeValue, 1, c.Mode, c.LogLevel, strconv.FormatBool(c.IPv6), strconv.FormatBool(c.AllowLan), c.BindAddress)
+	for _, p := range []struct {
+		kind string
+		port int
+	}{
+		{kind: "mixed", port: c.MixedPort},
+		{kind: "socks", port: c.SocksPort},
+		{kind: "http", port: c.Port},
+		{kind: "redir", port: c.RedirPort},
+		{kind: "tproxy", port: c.TProxyPort},
+	} {
+		if p.port != 0 {
+			metrics <- prometheus.MustNewConstMetric(configPort, prometheus.GaugeValue, float64(p.port), p.kind)
+		}
+	}
+	tun := 0.0
+	if c.Tun != nil && c.Tun.Enable {
+		tun = 1
+	}
+	metrics <- prometheus.MustNewConstMetric(tunEnabled, prometheus.GaugeValue, tun)
+	metrics <- prometheus.MustNewConstMetric(configChanges, prometheus.CounterValue, float64(t.changes))
+}
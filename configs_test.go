@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestConfigTrackerChanges(t *testing.T) {
+	tracker := NewConfigTracker()
+	for _, raw := range []string{
+		`{"mode":"rule","log-level":"info","allow-lan":false}`,
+		`{"allow-lan":false,"log-level":"info","mode":"rule"}`,
+		`{"mode":"direct","log-level":"info","allow-lan":false}`,
+		`{"mode":"direct","log-level":"info","allow-lan":false}`,
+		`{"mode":"rule","log-level":"info","allow-lan":false}`,
+	} {
+		c := &Configs{Raw: json.RawMessage(raw)}
+		if err := json.Unmarshal(c.Raw, c); err != nil {
+			t.Fatal(err)
+		}
+		if err := tracker.Update(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `
+# HELP clash_config_changes_total Number of times the running configuration changed between polls.
+# TYPE clash_config_changes_total counter
+clash_config_changes_total 2
+# HELP clash_config_info Running configuration of Clash.
+# TYPE clash_config_info gauge
+clash_config_info{allow_lan="false",bind_address="",ipv6="false",log_level="info",mode="rule"} 1
+`
+	if err := testutil.CollectAndCompare(tracker, strings.NewReader(expected), "clash_config_changes_total", "clash_config_info"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	connectionsActive = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connections", "active"), "Number of open connections.", []string{"network", "type", "rule"}, nil)
+	connectionsOpened = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connections", "opened_total"), "Number of connections seen opened, connections shorter than the poll interval are missed.", []string{"network", "type", "rule"}, nil)
+)
+
+type connectionKey struct {
+	network string
+	typ     string
+	rule    string
+}
+
+func newConnectionKey(d *ConnectionDelta) connectionKey {
+	k := connectionKey{rule: d.Rule}
+	if d.Metadata != nil {
+		k.network, k.typ = d.Metadata.NetWork, d.Metadata.Type
+	}
+	return k
+}
+
+// ConnectionStats counts open and opened connections by network, inbound type and rule.
+type ConnectionStats struct {
+	mutex  sync.Mutex
+	active map[connectionKey]int
+	opened map[connectionKey]int
+}
+
+func NewConnectionStats() *ConnectionStats {
+	return &ConnectionStats{
+		active: make(map[connectionKey]int),
+		opened: make(map[connectionKey]int),
+	}
+}
+
+func (s *ConnectionStats) ObserveConnections(deltas []*ConnectionDelta) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active = make(map[connectionKey]int)
+	for _, d := range deltas {
+		if d.Closed {
+			continue
+		}
+		k := newConnectionKey(d)
+		s.active[k]++
+		if d.Opened {
+			s.opened[k]++
+		}
+	}
+}
+
+func (s *ConnectionStats) Describe(descs chan<- *prometheus.Desc) {
+	descs <- connectionsActive
+	descs <- connectionsOpened
+}
+
+func (s *ConnectionStats) Collect(metrics chan<- prometheus.Metric) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, n := range s.active {
+		metrics <- prometheus.MustNewConstMetric(connectionsActive, prometheus.GaugeValue, float64(n), k.network, k.typ, k.rule)
+	}
+	for k, n := range s.opened {
+		metrics <- prometheus.MustNewConstMetric(connectionsOpened, prometheus.CounterValue, float64(n), k.network, k.typ, k.rule)
+	}
+}
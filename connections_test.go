@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionStats(t *testing.T) {
+	stats := NewConnectionStats()
+	tracker := NewConnectionTracker(stats)
+	now := time.Unix(1600000100, 0)
+	udp := newTrackerInfo("c", 0, 0, "Match", "", "DIRECT")
+	udp.Metadata.NetWork, udp.Metadata.Type = "udp", "TUN"
+
+	// a and b were opened before the first snapshot.
+	tracker.Update(&Snapshot{Connections: []*TrackerInfo{
+		newTrackerInfo("a", 0, 0, "Match", "", "DIRECT"),
+		newTrackerInfo("b", 0, 0, "Match", "", "DIRECT"),
+	}}, now)
+	// a is closed and c is opened.
+	tracker.Update(&Snapshot{Connections: []*TrackerInfo{
+		newTrackerInfo("b", 0, 0, "Match", "", "DIRECT"),
+		udp,
+	}}, now.Add(time.Second))
+
+	expected := `
+# HELP clash_connections_active Number of open connections.
+# TYPE clash_connections_active gauge
+clash_connections_active{network="tcp",rule="Match",type="HTTP"} 1
+clash_connections_active{network="udp",rule="Match",type="TUN"} 1
+# HELP clash_connections_opened_total Number of connections seen opened, connections shorter than the poll interval are missed.
+# TYPE clash_connections_opened_total counter
+clash_connections_opened_total{network="udp",rule="Match",type="TUN"} 1
+`
+	if err := testutil.CollectAndCompare(stats, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
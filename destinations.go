@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	// otherDestinations collects the bytes of the destinations outside of the top K.
+	otherDestinations = otherLabel
+	// topDestinationsCapacity is how many more destinations than K are counted by the sketch,
+	// which makes the top K unlikely to miss a heavy hitter.
+	topDestinationsCapacity = 10
+)
+
+var topDestinationBytes = prometheus.NewDesc(prometheus.BuildFQName(namespace, "top_destination", "bytes"), "Estimated number of bytes transferred with the destination host through the outbound, for the top destinations only.", []string{"host", "outbound"}, nil)
+
+type destinationKey struct {
+	host     string
+	outbound string
+}
+
+// Destination is a heavy hitter of TopDestinations. Bytes overestimates the bytes
+// of the destination by at most Error.
+type Destination struct {
+	Host     string `json:"host"`
+	Outbound string `json:"outbound"`
+	Bytes    int64  `json:"bytes"`
+	Error    int64  `json:"error"`
+}
+
+// TopDestinations finds the destinations that transfer the most bytes with the space-saving
+// algorithm, which counts at most a fixed number of destinations by replacing the smallest one.
+type TopDestinations struct {
+	k        int
+	capacity int
+
+	mutex     sync.Mutex
+	counters  map[destinationKey]*Destination
+	outbounds map[string]int64
+}
+
+func NewTopDestinations(k int) *TopDestinations {
+	return &TopDestinations{
+		k:         k,
+		capacity:  k * topDestinationsCapacity,
+		counters:  make(map[destinationKey]*Destination),
+		outbounds: make(map[string]int64),
+	}
+}
+
+func (t *TopDestinations) ObserveConnections(deltas []*ConnectionDelta) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, d := range deltas {
+		n := d.Upload + d.Download
+		if n == 0 || d.Metadata == nil {
+			continue
+		}
+		host := d.Metadata.Host
+		if host == "" && d.Metadata.DstIP != nil {
+			host = d.Metadata.DstIP.String()
+		}
+		t.add(destinationKey{host: host, outbound: d.Outbound()}, n)
+	}
+}
+
+func (t *TopDestinations) add(k destinationKey, n int64) {
+	t.outbounds[k.outbound] += n
+	if c, ok := t.counters[k]; ok {
+		c.Bytes += n
+		return
+	}
+	if len(t.counters) < t.capacity {
+		t.counters[k] = &Destination{Host: k.host, Outbound: k.outbound, Bytes: n}
+		return
+	}
+	var minKey destinationKey
+	var min *Destination
+	for key, c := range t.counters {
+		if min == nil || c.Bytes < min.Bytes {
+			minKey, min = key, c
+		}
+	}
+	delete(t.counters, minKey)
+	t.counters[k] = &Destination{Host: k.host, Outbound: k.outbound, Bytes: min.Bytes + n, Error: min.Bytes}
+}
+
+// Top returns the top K destinations by bytes.
+func (t *TopDestinations) Top() []Destination {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.top()
+}
+
+func (t *TopDestinations) top() []Destination {
+	top := make([]Destination, 0, len(t.counters))
+	for _, c := range t.counters {
+		top = append(top, *c)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Host < top[j].Host
+	})
+	if len(top) > t.k {
+		top = top[:t.k]
+	}
+	return top
+}
+
+func (t *TopDestinations) Describe(descs chan<- *prometheus.Desc) {
+	descs <- topDestinationBytes
+}
+
+func (t *TopDestinations) Collect(metrics chan<- prometheus.Metric) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	others := make(map[string]int64, len(t.outbounds))
+	for outbound, n := range t.outbounds {
+		others[outbound] = n
+	}
+	for _, d := range t.top() {
+		metrics <- prometheus.MustNewConstMetric(topDestinationBytes, prometheus.GaugeValue, float64(d.Bytes), d.Host, d.Outbound)
+		others[d.Outbound] -= d.Bytes
+	}
+	for outbound, n := range others {
+		metrics <- prometheus.MustNewConstMetric(topDestinationBytes, prometheus.GaugeValue, float64(nonNegative(n)), otherDestinations, outbound)
+	}
+}
+
+// ServeHTTP writes the top K destinations as JSON.
+func (t *TopDestinations) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Top()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopDestinations(t *testing.T) {
+	top := NewTopDestinations(2)
+	var deltas []*ConnectionDelta
+	// Many small destinations through DIRECT evict each other, the heavy hitters stay counted.
+	for i := 0; i < 100; i++ {
+		deltas = append(deltas,
+			&ConnectionDelta{TrackerInfo: newTrackerInfo(fmt.Sprint("small", i), 0, 1, "Match", "", "DIRECT"), Download: 1},
+			&ConnectionDelta{TrackerInfo: newTrackerInfo("video", 0, 0, "Match", "", "HK"), Download: 100},
+			&ConnectionDelta{TrackerInfo: newTrackerInfo("mail", 0, 0, "Match", "", "DIRECT"), Upload: 10},
+		)
+	}
+	top.ObserveConnections(deltas)
+
+	expected := `
+# HELP clash_top_destination_bytes Estimated number of bytes transferred with the destination host through the outbound, for the top destinations only.
+# TYPE clash_top_destination_bytes gauge
+clash_top_destination_bytes{host="__other__",outbound="DIRECT"} 100
+clash_top_destination_bytes{host="__other__",outbound="HK"} 0
+clash_top_destination_bytes{host="mail.example.com",outbound="DIRECT"} 1000
+clash_top_destination_bytes{host="video.example.com",outbound="HK"} 10000
+`
+	if err := testutil.CollectAndCompare(top, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	top.ServeHTTP(w, httptest.NewRequest("GET", "/destinations", nil))
+	var actual []Destination
+	if err := json.Unmarshal(w.Body.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, top.Top()) || actual[0].Host != "video.example.com" {
+		t.Fatalf("unexpected ranking: %+v", actual)
+	}
+}
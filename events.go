@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"sync"
+)
+
+// ConnectionEventFields are the fields of the JSON lines written by ConnectionEventLog.
+var ConnectionEventFields = []string{
+	"id", "start", "end", "duration_seconds", "network", "type",
+	"source_ip", "source_port", "destination_host", "destination_ip", "destination_port",
+	"rule", "rule_payload", "chain", "upload", "download",
+}
+
+var (
+	connectionEvents      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection_events", "written_total"), "Number of connection events written.", nil, nil)
+	connectionEventErrors = prometheus.NewDesc(prometheus.BuildFQName(namespace, "connection_events", "errors_total"), "Number of connection events that failed to be written.", nil, nil)
+)
+
+// ConnectionEventLog writes a JSON line with the selected fields of every closed connection to w.
+// The end of a connection is the snapshot that misses it, so it is up to a poll interval too late.
+type ConnectionEventLog struct {
+	w       io.Writer
+	fields  []string
+	hashKey []byte
+
+	mutex   sync.Mutex
+	written int64
+	errors  int64
+}
+
+// NewConnectionEventLog returns a ConnectionEventLog writing fields, or all ConnectionEventFields if empty.
+// If hashKey is not empty, source IPs are replaced with their HMAC-SHA256 keyed with hashKey,
+// which keeps them distinguishable without revealing them.
+func NewConnectionEventLog(w io.Writer, fields []string, hashKey string) (*ConnectionEventLog, error) {
+	if len(fields) == 0 {
+		fields = ConnectionEventFields
+	}
+	for _, f := range fields {
+		known := false
+		for _, k := range ConnectionEventFields {
+			known = known || f == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown connection event field %q", f)
+		}
+	}
+	return &ConnectionEventLog{w: w, fields: fields, hashKey: []byte(hashKey)}, nil
+}
+
+func (l *ConnectionEventLog) event(d *ConnectionDelta) map[string]interface{} {
+	m := d.Metadata
+	if m == nil {
+		m = &Metadata{}
+	}
+	sourceIP := ""
+	if m.SrcIP != nil {
+		sourceIP = m.SrcIP.String()
+		if len(l.hashKey) > 0 {
+			mac := hmac.New(sha256.New, l.hashKey)
+			mac.Write([]byte(sourceIP))
+			sourceIP = hex.EncodeToString(mac.Sum(nil))
+		}
+	}
+	destinationIP := ""
+	if m.DstIP != nil {
+		destinationIP = m.DstIP.String()
+	}
+	all := map[string]interface{}{
+		"id":               d.UUID,
+		"start":            d.Start,
+		"end":              d.Time,
+		"duration_seconds": d.Time.Sub(d.Start).Seconds(),
+		"network":          m.NetWork,
+		"type":             m.Type,
+		"source_ip":        sourceIP,
+		"source_port":      m.SrcPort,
+		"destination_host": m.Host,
+		"destination_ip":   destinationIP,
+		"destination_port": m.DstPort,
+		"rule":             d.Rule,
+		"rule_payload":     d.RulePayload,
+		"chain":            d.Chain,
+		"upload":           d.UploadTotal,
+		"download":         d.DownloadTotal,
+	}
+	event := make(map[string]interface{}, len(l.fields))
+	for _, f := range l.fields {
+		event[f] = all[f]
+	}
+	return event
+}
+
+func (l *ConnectionEventLog) ObserveConnections(deltas []*ConnectionDelta) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, d := range deltas {
+		if !d.Closed {
+			continue
+		}
+		data, err := json.Marshal(l.event(d))
+		if err == nil {
+			_, err = l.w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			l.errors++
+			level.Warn(logger).Log("msg", "error when write connection event", "id", d.UUID, "err", err)
+			continue
+		}
+		l.written++
+	}
+}
+
+func (l *ConnectionEventLog) Describe(descs chan<- *prometheus.Desc) {
+	descs <- connectionEvents
+	descs <- connectionEventErrors
+}
+
+func (l *ConnectionEventLog) Collect(metrics chan<- prometheus.Metric) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	metrics <- prometheus.MustNewConstMetric(connectionEvents, prometheus.CounterValue, float64(l.written))
+	metrics <- prometheus.MustNewConstMetric(connectionEventErrors, prometheus.CounterValue, float64(l.errors))
+}
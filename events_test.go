@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionEventLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	events, err := NewConnectionEventLog(buf, []string{"id", "end", "duration_seconds", "source_ip", "destination_host", "chain", "download"}, "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := NewConnectionTracker(events)
+	a := newTrackerInfo("a", 10, 100, "Match", "", "HK", "Proxy")
+	a.Metadata.SrcIP = net.ParseIP("192.168.1.2")
+	tracker.Update(&Snapshot{UploadTotal: 10, DownloadTotal: 100, Connections: []*TrackerInfo{a}}, time.Unix(1600000050, 0))
+	tracker.Update(&Snapshot{UploadTotal: 10, DownloadTotal: 120}, time.Unix(1600000060, 0).UTC())
+
+	expected := `{"chain":["HK","Proxy"],"destination_host":"a.example.com","download":120,"duration_seconds":60,"end":"2020-09-13T12:27:40Z","id":"a","source_ip":"cb1b69c4e06471bf994a2b34621f408ef0e17f2ec4b1cc63ed18e9d36cde3c3c"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected event %s, got %s", expected, buf.String())
+	}
+
+	if _, err := NewConnectionEventLog(buf, []string{"password"}, ""); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Errorf("expected error of unknown field, got %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FlowProtocolIPFIX     = "ipfix"
+	FlowProtocolNetFlowV9 = "netflow9"
+	// DefaultFlowEnterpriseNumber is the private enterprise number reserved for documentation by RFC 5612,
+	// which should be replaced with the number of the organization running the collector.
+	DefaultFlowEnterpriseNumber = 32473
+
+	// flowTemplateRefresh is how often the templates are sent again, as UDP collectors may miss them.
+	flowTemplateRefresh = time.Minute
+	// flowMaxMessageSize keeps messages within the MTU of ethernet.
+	flowMaxMessageSize = 1400
+	flowTemplateIPv4   = 256
+	flowTemplateIPv6   = 257
+	// variableLength is the field length of IPFIX fields whose length is given in each record.
+	variableLength = 65535
+)
+
+var (
+	flowRecordsSent  = prometheus.NewDesc(prometheus.BuildFQName(namespace, "flow", "records_sent_total"), "Number of flow records sent to the collector.", nil, nil)
+	flowExportErrors = prometheus.NewDesc(prometheus.BuildFQName(namespace, "flow", "export_errors_total"), "Number of flow messages that failed to be sent to the collector.", nil, nil)
+)
+
+// flowRecord is a closed connection in the form of a flow.
+type flowRecord struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	protocol         uint8
+	upload, download uint64
+	start, end       time.Time
+	rule, payload    string
+	chain, host      string
+}
+
+func newFlowRecord(d *ConnectionDelta) *flowRecord {
+	r := &flowRecord{
+		upload:   uint64(d.UploadTotal),
+		download: uint64(d.DownloadTotal),
+		start:    d.Start,
+		end:      d.Time,
+		rule:     d.Rule,
+		payload:  d.RulePayload,
+		chain:    strings.Join(d.Chain, ","),
+	}
+	if m := d.Metadata; m != nil {
+		r.src, r.dst, r.host = m.SrcIP, m.DstIP, m.Host
+		srcPort, _ := strconv.ParseUint(m.SrcPort, 10, 16)
+		dstPort, _ := strconv.ParseUint(m.DstPort, 10, 16)
+		r.srcPort, r.dstPort = uint16(srcPort), uint16(dstPort)
+		switch m.NetWork {
+		case "tcp":
+			r.protocol = 6
+		case "udp":
+			r.protocol = 17
+		}
+	}
+	return r
+}
+
+// ipv6 reports whether the record needs the IPv6 template, IPv4 addresses are then mapped to IPv6.
+// Unknown addresses, e.g. the destination of a domain resolved by the proxy, are sent as zeros.
+func (r *flowRecord) ipv6() bool {
+	return (r.src != nil && r.src.To4() == nil) || (r.dst != nil && r.dst.To4() == nil)
+}
+
+type flowField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+	encode     func(buf *bytes.Buffer, r *flowRecord)
+}
+
+func ipField(id uint16, ipv6 bool, ip func(r *flowRecord) net.IP) flowField {
+	length := uint16(net.IPv4len)
+	if ipv6 {
+		length = net.IPv6len
+	}
+	return flowField{id: id, length: length, encode: func(buf *bytes.Buffer, r *flowRecord) {
+		b := make([]byte, length)
+		if addr := ip(r); addr != nil {
+			if ipv6 {
+				copy(b, addr.To16())
+			} else {
+				copy(b, addr.To4())
+			}
+		}
+		buf.Write(b)
+	}}
+}
+
+func uintField(id uint16, length uint16, v func(r *flowRecord) uint64) flowField {
+	return flowField{id: id, length: length, encode: func(buf *bytes.Buffer, r *flowRecord) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v(r))
+		buf.Write(b[8-length:])
+	}}
+}
+
+// stringField is an enterprise-specific IPFIX field of variable length.
+// Strings are truncated to 254 bytes, which keeps records far below the message size.
+func stringField(id uint16, v func(r *flowRecord) string) flowField {
+	return flowField{id: id, length: variableLength, enterprise: true, encode: func(buf *bytes.Buffer, r *flowRecord) {
+		s := v(r)
+		if len(s) > 254 {
+			s = s[:254]
+		}
+		buf.WriteByte(byte(len(s)))
+		buf.WriteString(s)
+	}}
+}
+
+// flowFields returns the fields of the template of protocol. NetFlow v9 has no enterprise-specific
+// fields, so the rule and the chain are only sent with IPFIX. bootTime is the sysUptime origin of NetFlow v9.
+func flowFields(protocol string, ipv6 bool, bootTime time.Time) []flowField {
+	src, dst := uint16(8), uint16(12)
+	if ipv6 {
+		src, dst = 27, 28
+	}
+	fields := []flowField{
+		ipField(src, ipv6, func(r *flowRecord) net.IP { return r.src }),
+		ipField(dst, ipv6, func(r *flowRecord) net.IP { return r.dst }),
+		uintField(7, 2, func(r *flowRecord) uint64 { return uint64(r.srcPort) }),
+		uintField(11, 2, func(r *flowRecord) uint64 { return uint64(r.dstPort) }),
+		uintField(4, 1, func(r *flowRecord) uint64 { return uint64(r.protocol) }),
+	}
+	if protocol == FlowProtocolNetFlowV9 {
+		uptime := func(t time.Time) uint64 { return uint64(nonNegative(t.Sub(bootTime).Milliseconds())) }
+		return append(fields,
+			// IN_BYTES and OUT_BYTES
+			uintField(1, 8, func(r *flowRecord) uint64 { return r.upload }),
+			uintField(23, 8, func(r *flowRecord) uint64 { return r.download }),
+			// FIRST_SWITCHED and LAST_SWITCHED
+			uintField(22, 4, func(r *flowRecord) uint64 { return uptime(r.start) }),
+			uintField(21, 4, func(r *flowRecord) uint64 { return uptime(r.end) }),
+		)
+	}
+	return append(fields,
+		// initiatorOctets and responderOctets
+		uintField(231, 8, func(r *flowRecord) uint64 { return r.upload }),
+		uintField(232, 8, func(r *flowRecord) uint64 { return r.download }),
+		// flowStartMilliseconds and flowEndMilliseconds
+		uintField(152, 8, func(r *flowRecord) uint64 { return uint64(r.start.UnixNano() / int64(time.Millisecond)) }),
+		uintField(153, 8, func(r *flowRecord) uint64 { return uint64(r.end.UnixNano() / int64(time.Millisecond)) }),
+		stringField(1, func(r *flowRecord) string { return r.rule }),
+		stringField(2, func(r *flowRecord) string { return r.payload }),
+		stringField(3, func(r *flowRecord) string { return r.chain }),
+		stringField(4, func(r *flowRecord) string { return r.host }),
+	)
+}
+
+// FlowExporter sends closed connections as flow records to an IPFIX or NetFlow v9 collector over UDP.
+// The enterprise-specific IPFIX fields under enterpriseNumber are 1 for the rule, 2 for the rule payload,
+// 3 for the comma separated chain and 4 for the destination host.
+type FlowExporter struct {
+	conn              net.Conn
+	protocol          string
+	enterpriseNumber  uint32
+	observationDomain uint32
+	bootTime          time.Time
+	templates         map[uint16][]flowField
+
+	mutex        sync.Mutex
+	sequence     uint32
+	templateSent time.Time
+	sent         int64
+	errors       int64
+}
+
+func NewFlowExporter(collector, protocol string, enterpriseNumber, observationDomain uint32) (*FlowExporter, error) {
+	if protocol != FlowProtocolIPFIX && protocol != FlowProtocolNetFlowV9 {
+		return nil, fmt.Errorf("unknown flow protocol %q", protocol)
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	bootTime := time.Now()
+	return &FlowExporter{
+		conn:              conn,
+		protocol:          protocol,
+		enterpriseNumber:  enterpriseNumber,
+		observationDomain: observationDomain,
+		bootTime:          bootTime,
+		templates: map[uint16][]flowField{
+			flowTemplateIPv4: flowFields(protocol, false, bootTime),
+			flowTemplateIPv6: flowFields(protocol, true, bootTime),
+		},
+	}, nil
+}
+
+func (f *FlowExporter) ObserveConnections(deltas []*ConnectionDelta) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	sets := make(map[uint16]*bytes.Buffer)
+	var order []uint16
+	size := 0
+	records := 0
+	flush := func() {
+		if size == 0 {
+			return
+		}
+		f.send(now, order, sets, records)
+		sets, order, size, records = make(map[uint16]*bytes.Buffer), nil, 0, 0
+	}
+	for _, d := range deltas {
+		if !d.Closed {
+			continue
+		}
+		r := newFlowRecord(d)
+		id := uint16(flowTemplateIPv4)
+		if r.ipv6() {
+			id = flowTemplateIPv6
+		}
+		record := &bytes.Buffer{}
+		for _, field := range f.templates[id] {
+			field.encode(record, r)
+		}
+		if size+record.Len()+4 > flowMaxMessageSize-f.headerLength()-f.templateSetLength() {
+			flush()
+		}
+		set, ok := sets[id]
+		if !ok {
+			set = &bytes.Buffer{}
+			sets[id] = set
+			order = append(order, id)
+			size += 4
+		}
+		set.Write(record.Bytes())
+		size += record.Len()
+		records++
+	}
+	flush()
+}
+
+func (f *FlowExporter) headerLength() int {
+	if f.protocol == FlowProtocolNetFlowV9 {
+		return 20
+	}
+	return 16
+}
+
+func (f *FlowExporter) templateSetLength() int {
+	return f.templateSet().Len()
+}
+
+// templateSet encodes the template set, or the template FlowSet of NetFlow v9.
+func (f *FlowExporter) templateSet() *bytes.Buffer {
+	body := &bytes.Buffer{}
+	for _, id := range []uint16{flowTemplateIPv4, flowTemplateIPv6} {
+		fields := f.templates[id]
+		_ = binary.Write(body, binary.BigEndian, []uint16{id, uint16(len(fields))})
+		for _, field := range fields {
+			if field.enterprise {
+				_ = binary.Write(body, binary.BigEndian, []uint16{field.id | 0x8000, field.length})
+				_ = binary.Write(body, binary.BigEndian, f.enterpriseNumber)
+			} else {
+				_ = binary.Write(body, binary.BigEndian, []uint16{field.id, field.length})
+			}
+		}
+	}
+	setID := uint16(2)
+	if f.protocol == FlowProtocolNetFlowV9 {
+		setID = 0
+	}
+	set := &bytes.Buffer{}
+	_ = binary.Write(set, binary.BigEndian, []uint16{setID, uint16(body.Len() + 4)})
+	set.Write(body.Bytes())
+	return set
+}
+
+func (f *FlowExporter) send(now time.Time, order []uint16, sets map[uint16]*bytes.Buffer, records int) {
+	body := &bytes.Buffer{}
+	count := records
+	if now.Sub(f.templateSent) >= flowTemplateRefresh {
+		body.Write(f.templateSet().Bytes())
+		count += len(f.templates)
+		f.templateSent = now
+	}
+	for _, id := range order {
+		set := sets[id]
+		// NetFlow v9 requires FlowSets to be padded to 4 bytes.
+		padding := 0
+		if f.protocol == FlowProtocolNetFlowV9 {
+			padding = (4 - set.Len()%4) % 4
+		}
+		_ = binary.Write(body, binary.BigEndian, []uint16{id, uint16(set.Len() + padding + 4)})
+		body.Write(set.Bytes())
+		body.Write(make([]byte, padding))
+	}
+
+	message := &bytes.Buffer{}
+	if f.protocol == FlowProtocolNetFlowV9 {
+		uptime := uint32(now.Sub(f.bootTime).Milliseconds())
+		_ = binary.Write(message, binary.BigEndian, []uint16{9, uint16(count)})
+		_ = binary.Write(message, binary.BigEndian, []uint32{uptime, uint32(now.Unix()), f.sequence, f.observationDomain})
+		f.sequence++
+	} else {
+		_ = binary.Write(message, binary.BigEndian, []uint16{10, uint16(body.Len() + 16)})
+		_ = binary.Write(message, binary.BigEndian, []uint32{uint32(now.Unix()), f.sequence, f.observationDomain})
+		// The sequence number of IPFIX counts the data records.
+		f.sequence += uint32(records)
+	}
+	message.Write(body.Bytes())
+	if _, err := f.conn.Write(message.Bytes()); err != nil {
+		f.errors++
+		// The templates have to be sent again with the next message.
+		f.templateSent = time.Time{}
+		level.Warn(logger).Log("msg", "error when send flow records", "collector", f.conn.RemoteAddr(), "err", err)
+		return
+	}
+	f.sent += int64(records)
+}
+
+func (f *FlowExporter) Describe(descs chan<- *prometheus.Desc) {
+	descs <- flowRecordsSent
+	descs <- flowExportErrors
+}
+
+func (f *FlowExporter) Collect(metrics chan<- prometheus.Metric) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	metrics <- prometheus.MustNewConstMetric(flowRecordsSent, prometheus.CounterValue, float64(f.sent))
+	metrics <- prometheus.MustNewConstMetric(flowExportErrors, prometheus.CounterValue, float64(f.errors))
+}
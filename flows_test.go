@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// flowCollectorStub decodes the data records of the IPFIX or NetFlow v9 messages it receives by field ID,
+// enterprise-specific fields are keyed with the enterprise bit set.
+type flowCollectorStub struct {
+	t         *testing.T
+	conn      net.PacketConn
+	templates map[uint16][][2]uint16
+}
+
+func newFlowCollectorStub(t *testing.T) *flowCollectorStub {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &flowCollectorStub{t: t, conn: conn, templates: make(map[uint16][][2]uint16)}
+}
+
+func (c *flowCollectorStub) receive() (version uint16, records []map[uint16][]byte) {
+	buf := make([]byte, 65535)
+	_ = c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	buf = buf[:n]
+	version = binary.BigEndian.Uint16(buf)
+	header := 16
+	templateSet := uint16(2)
+	if version == 9 {
+		header, templateSet = 20, 0
+	} else if int(binary.BigEndian.Uint16(buf[2:])) != n {
+		c.t.Fatalf("message length %d does not match %d bytes received", binary.BigEndian.Uint16(buf[2:]), n)
+	}
+	for sets := buf[header:]; len(sets) > 0; {
+		id, length := binary.BigEndian.Uint16(sets), binary.BigEndian.Uint16(sets[2:])
+		set := sets[4:length]
+		sets = sets[length:]
+		if id == templateSet {
+			for len(set) > 0 {
+				templateID, count := binary.BigEndian.Uint16(set), binary.BigEndian.Uint16(set[2:])
+				set = set[4:]
+				var fields [][2]uint16
+				for i := 0; i < int(count); i++ {
+					field := [2]uint16{binary.BigEndian.Uint16(set), binary.BigEndian.Uint16(set[2:])}
+					set = set[4:]
+					if field[0]&0x8000 != 0 {
+						set = set[4:]
+					}
+					fields = append(fields, field)
+				}
+				c.templates[templateID] = fields
+			}
+			continue
+		}
+		fields, ok := c.templates[id]
+		if !ok {
+			c.t.Fatalf("data set of unknown template %d", id)
+		}
+		for len(set) >= 4 {
+			record := make(map[uint16][]byte)
+			for _, field := range fields {
+				length := int(field[1])
+				if field[1] == variableLength {
+					length = int(set[0])
+					set = set[1:]
+				}
+				record[field[0]] = set[:length]
+				set = set[length:]
+			}
+			records = append(records, record)
+		}
+	}
+	return version, records
+}
+
+func TestFlowExporter(t *testing.T) {
+	collector := newFlowCollectorStub(t)
+	a := newTrackerInfo("a", 10, 100, "DomainSuffix", "google.com", "HK", "Proxy")
+	a.Metadata.SrcIP, a.Metadata.DstIP = net.ParseIP("192.168.1.2"), net.ParseIP("142.250.1.1")
+	a.Metadata.SrcPort, a.Metadata.DstPort = "52341", "443"
+	b := newTrackerInfo("b", 20, 200, "Match", "", "DIRECT")
+	b.Metadata.NetWork = "udp"
+	b.Metadata.SrcIP, b.Metadata.DstIP = net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1")
+	b.Metadata.SrcPort, b.Metadata.DstPort = "5353", "53"
+	snapshot := &Snapshot{UploadTotal: 30, DownloadTotal: 300, Connections: []*TrackerInfo{a, b}}
+
+	for _, protocol := range []string{FlowProtocolIPFIX, FlowProtocolNetFlowV9} {
+		flows, err := NewFlowExporter(collector.conn.LocalAddr().String(), protocol, DefaultFlowEnterpriseNumber, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker := NewConnectionTracker(flows)
+		tracker.Update(snapshot, time.Unix(1600000050, 0))
+		tracker.Update(&Snapshot{UploadTotal: 30, DownloadTotal: 300}, time.Unix(1600000060, 0))
+
+		version, records := collector.receive()
+		if len(records) != 2 {
+			t.Fatalf("%s: expected 2 records, got %d", protocol, len(records))
+		}
+		v4, v6 := records[0], records[1]
+		if net.IP(v4[8]).String() != "192.168.1.2" || net.IP(v4[12]).String() != "142.250.1.1" || binary.BigEndian.Uint16(v4[7]) != 52341 || v4[4][0] != 6 {
+			t.Errorf("%s: unexpected 5-tuple of IPv4 record: %v", protocol, v4)
+		}
+		if net.IP(v6[27]).String() != "fd00::2" || net.IP(v6[28]).String() != "2001:db8::1" || binary.BigEndian.Uint16(v6[11]) != 53 || v6[4][0] != 17 {
+			t.Errorf("%s: unexpected 5-tuple of IPv6 record: %v", protocol, v6)
+		}
+		switch protocol {
+		case FlowProtocolIPFIX:
+			if version != 10 || binary.BigEndian.Uint64(v4[231]) != 10 || binary.BigEndian.Uint64(v4[232]) != 100 ||
+				binary.BigEndian.Uint64(v4[152]) != 1600000000000 || binary.BigEndian.Uint64(v4[153]) != 1600000060000 {
+				t.Errorf("%s: unexpected bytes or times of record: %v", protocol, v4)
+			}
+			if string(v4[0x8001]) != "DomainSuffix" || string(v4[0x8002]) != "google.com" || string(v4[0x8003]) != "HK,Proxy" || string(v4[0x8004]) != "a.example.com" {
+				t.Errorf("%s: unexpected enterprise fields of record: %v", protocol, v4)
+			}
+		case FlowProtocolNetFlowV9:
+			if version != 9 || binary.BigEndian.Uint64(v4[1]) != 10 || binary.BigEndian.Uint64(v4[23]) != 100 {
+				t.Errorf("%s: unexpected bytes of record: %v", protocol, v4)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLogForwardLevel = "info"
+	// logForwardQueueSize is how many entries wait for a slow output before new ones are dropped.
+	logForwardQueueSize = 1024
+	// syslogFacility is the daemon facility of RFC 5424.
+	syslogFacility = 3
+	// syslogTimeFormat is the TIMESTAMP of RFC 5424, which allows at most 6 digits of fractional seconds.
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// syslogSeverities maps the levels of Clash to the severities of RFC 5424.
+var syslogSeverities = map[string]int{
+	"debug":   7,
+	"info":    6,
+	"warning": 4,
+	"error":   3,
+}
+
+// logOutput writes forwarded log entries.
+type logOutput interface {
+	WriteLog(t time.Time, l *LogEntry) error
+	Close() error
+}
+
+// NewLogOutput returns the output of target, which is a syslog server given by udp://host:port,
+// tcp://host:port or unix:///path/to/socket, or otherwise a file rotated at maxSize bytes.
+func NewLogOutput(target string, maxSize int64, maxBackups int) (logOutput, error) {
+	if !strings.Contains(target, "://") {
+		f, err := OpenRotatingFile(target, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return &logFileOutput{w: f}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	switch u.Scheme {
+	case "udp", "tcp":
+		return &syslogOutput{network: u.Scheme, address: u.Host, hostname: hostname}, nil
+	case "unix":
+		return &syslogOutput{network: "unixgram", address: u.Path, hostname: hostname}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q of log forward target %q", u.Scheme, target)
+}
+
+// logFileOutput writes entries as lines of time, level and message.
+type logFileOutput struct {
+	w io.WriteCloser
+}
+
+func (o *logFileOutput) WriteLog(t time.Time, l *LogEntry) error {
+	_, err := fmt.Fprintf(o.w, "%s %s %s\n", t.Format(time.RFC3339Nano), l.Type, l.Payload)
+	return err
+}
+
+func (o *logFileOutput) Close() error {
+	return o.w.Close()
+}
+
+// syslogOutput sends entries as RFC 5424 messages, framed by octet counting on stream connections.
+type syslogOutput struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+func (o *syslogOutput) format(t time.Time, l *LogEntry) string {
+	severity, ok := syslogSeverities[l.Type]
+	if !ok {
+		severity = 5
+	}
+	hostname := o.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	return fmt.Sprintf("<%d>1 %s %s clash - - - %s", syslogFacility*8+severity, t.Format(syslogTimeFormat), hostname, l.Payload)
+}
+
+func (o *syslogOutput) WriteLog(t time.Time, l *LogEntry) error {
+	msg := o.format(t, l)
+	if o.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	// A broken connection is dialed again once before the entry is given up.
+	var err error
+	for i := 0; i < 2; i++ {
+		if o.conn == nil {
+			if o.conn, err = net.DialTimeout(o.network, o.address, DefaultClientTimeout); err != nil {
+				o.conn = nil
+				continue
+			}
+		}
+		_ = o.conn.SetWriteDeadline(time.Now().Add(DefaultClientTimeout))
+		if _, err = io.WriteString(o.conn, msg); err == nil {
+			return nil
+		}
+		_ = o.conn.Close()
+		o.conn = nil
+	}
+	return err
+}
+
+func (o *syslogOutput) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	return o.conn.Close()
+}
+
+type timedLogEntry struct {
+	time  time.Time
+	entry *LogEntry
+}
+
+// LogForwarder forwards the entries of the /logs stream at level to an output.
+// Entries are dropped and counted when the output cannot keep up or fails, and a break
+// of the stream is forwarded as an entry of its own, so that gaps are never silent.
+type LogForwarder struct {
+	level  string
+	output logOutput
+
+	entries   chan timedLogEntry
+	forwarded prometheus.Counter
+	dropped   *prometheus.CounterVec
+	breaks    prometheus.Counter
+}
+
+// checkLogForwardLevel returns an error if level is not a level of Clash that can be forwarded.
+func checkLogForwardLevel(level string) error {
+	if _, ok := syslogSeverities[level]; !ok {
+		return fmt.Errorf("unknown log forward level %q, expected one of debug, info, warning or error", level)
+	}
+	return nil
+}
+
+func NewLogForwarder(output logOutput, level string) *LogForwarder {
+	return &LogForwarder{
+		level:   level,
+		output:  output,
+		entries: make(chan timedLogEntry, logForwardQueueSize),
+		forwarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "log_forward",
+			Name:      "entries_total",
+			Help:      "Number of log entries forwarded.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "log_forward",
+			Name:      "dropped_entries_total",
+			Help:      "Number of log entries that were not forwarded, because the queue was full or the output failed.",
+		}, []string{"reason"}),
+		breaks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "log_forward",
+			Name:      "stream_breaks_total",
+			Help:      "Number of times the log stream broke, entries logged until it is reconnected are lost.",
+		}),
+	}
+}
+
+func (f *LogForwarder) enqueue(t time.Time, l *LogEntry) {
+	select {
+	case f.entries <- timedLogEntry{time: t, entry: l}:
+	default:
+		f.dropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+func (f *LogForwarder) HandleLog(data []byte) error {
+	l := new(LogEntry)
+	if err := json.Unmarshal(data, l); err != nil {
+		return err
+	}
+	f.enqueue(time.Now(), l)
+	return nil
+}
+
+// StreamBroken forwards a warning about the entries lost until the stream is reconnected.
+func (f *LogForwarder) StreamBroken(err error) {
+	f.breaks.Inc()
+	f.enqueue(time.Now(), &LogEntry{Type: "warning", Payload: fmt.Sprintf("clash_exporter: log stream broken, entries may be lost until it is reconnected: %v", err)})
+}
+
+// Run writes the queued entries to the output until ctx is done, then closes the output.
+func (f *LogForwarder) Run(ctx context.Context) {
+	defer func() { _ = f.output.Close() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-f.entries:
+			if err := f.output.WriteLog(e.time, e.entry); err != nil {
+				f.dropped.WithLabelValues("output_error").Inc()
+				level.Warn(logger).Log("msg", "error when forward log entry", "err", err)
+				continue
+			}
+			f.forwarded.Inc()
+		}
+	}
+}
+
+func (f *LogForwarder) Describe(descs chan<- *prometheus.Desc) {
+	f.forwarded.Describe(descs)
+	f.dropped.Describe(descs)
+	f.breaks.Describe(descs)
+}
+
+func (f *LogForwarder) Collect(metrics chan<- prometheus.Metric) {
+	f.forwarded.Collect(metrics)
+	f.dropped.Collect(metrics)
+	f.breaks.Collect(metrics)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogForwarderSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	output, err := NewLogOutput("udp://"+conn.LocalAddr().String(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewLogForwarder(output, "info")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+
+	if err := f.HandleLog([]byte(`{"type":"warning","payload":"[TCP] dial DIRECT 192.168.1.2:50000 --> www.google.com:443 error: connect failed"}`)); err != nil {
+		t.Fatal(err)
+	}
+	f.StreamBroken(errors.New("unexpected EOF"))
+
+	for _, expected := range []string{
+		`^<28>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) \S+ clash - - - \[TCP\] dial DIRECT 192\.168\.1\.2:50000 --> www\.google\.com:443 error: connect failed$`,
+		`^<28>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) \S+ clash - - - clash_exporter: log stream broken, entries may be lost until it is reconnected: unexpected EOF$`,
+	} {
+		buf := make([]byte, 2048)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile(expected).Match(buf[:n]) {
+			t.Errorf("expected message matching %s, got %s", expected, buf[:n])
+		}
+	}
+}
+
+func TestCheckLogForwardLevel(t *testing.T) {
+	for level, valid := range map[string]bool{"debug": true, "info": true, "warning": true, "error": true, "warn": false, "silent": false, "": false} {
+		if err := checkLogForwardLevel(level); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", level, valid, err)
+		}
+	}
+}
+
+func TestLogForwarderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clash.log")
+	output, err := NewLogOutput(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewLogForwarder(output, "info")
+	// The output is not running, so the entries beyond the queue are dropped.
+	for i := 0; i < logForwardQueueSize+2; i++ {
+		if err := f.HandleLog([]byte(`{"type":"info","payload":"[DNS] resolved"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(f.forwarded) < logForwardQueueSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != logForwardQueueSize || !strings.HasSuffix(lines[0], " info [DNS] resolved") {
+		t.Errorf("expected %d lines of the entries, got %d: %q", logForwardQueueSize, len(lines), lines[0])
+	}
+	expected := `
+# HELP clash_log_forward_dropped_entries_total Number of log entries that were not forwarded, because the queue was full or the output failed.
+# TYPE clash_log_forward_dropped_entries_total counter
+clash_log_forward_dropped_entries_total{reason="queue_full"} 2
+`
+	if err := testutil.CollectAndCompare(f, strings.NewReader(expected), "clash_log_forward_dropped_entries_total"); err != nil {
+		t.Fatal(err)
+	}
+}
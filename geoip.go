@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// maxASNs is the maximum number of networks with their own metrics, the others are accounted as otherASNs.
+const (
+	maxASNs   = 1000
+	otherASNs = otherLabel
+)
+
+var (
+	destinationCountryBytes = prometheus.NewDesc(prometheus.BuildFQName(namespace, "destination", "country_bytes_total"), "Number of bytes transferred with destinations in the country through the outbound.", []string{"country", "outbound"}, nil)
+	destinationASNBytes     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "destination", "asn_bytes_total"), "Number of bytes transferred with destinations in the autonomous system.", []string{"asn", "org"}, nil)
+)
+
+// GeoDatabase is a MaxMind database file that is reopened when it changes.
+type GeoDatabase struct {
+	path string
+
+	mutex  sync.Mutex
+	info   os.FileInfo
+	reader *maxminddb.Reader
+}
+
+func NewGeoDatabase(path string) *GeoDatabase {
+	db := &GeoDatabase{path: path}
+	db.Refresh()
+	return db
+}
+
+// Refresh reopens the file if it changed or was replaced, like DeviceResolver.Refresh.
+func (db *GeoDatabase) Refresh() {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		level.Warn(logger).Log("msg", "error when stat geoip database", "file", db.path, "err", err)
+		return
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.info != nil && !fileChanged(db.info, fi) {
+		return
+	}
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		level.Warn(logger).Log("msg", "error when open geoip database", "file", db.path, "err", err)
+		return
+	}
+	if db.reader != nil {
+		_ = db.reader.Close()
+	}
+	db.reader = reader
+	db.info = fi
+	level.Info(logger).Log("msg", "geoip database loaded", "file", db.path, "type", reader.Metadata.DatabaseType)
+}
+
+// Lookup decodes the record of ip into result, which is left untouched if ip is not found.
+func (db *GeoDatabase) Lookup(ip net.IP, result interface{}) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	return db.reader.Lookup(ip, result)
+}
+
+type countryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type countryKey struct {
+	country  string
+	outbound string
+}
+
+type asnKey struct {
+	asn string
+	org string
+}
+
+// GeoTraffic accounts connection deltas to the country and the autonomous system of the destination IP.
+// Either database can be nil to skip its metrics.
+type GeoTraffic struct {
+	countryDB *GeoDatabase
+	asnDB     *GeoDatabase
+
+	mutex     sync.Mutex
+	countries map[countryKey]int64
+	asns      map[asnKey]int64
+}
+
+func NewGeoTraffic(countryDB, asnDB *GeoDatabase) *GeoTraffic {
+	return &GeoTraffic{
+		countryDB: countryDB,
+		asnDB:     asnDB,
+		countries: make(map[countryKey]int64),
+		asns:      make(map[asnKey]int64),
+	}
+}
+
+func (g *GeoTraffic) ObserveConnections(deltas []*ConnectionDelta) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, d := range deltas {
+		n := d.Upload + d.Download
+		if n == 0 || d.Metadata == nil || d.Metadata.DstIP == nil {
+			continue
+		}
+		ip := d.Metadata.DstIP
+		if g.countryDB != nil {
+			var r countryRecord
+			if err := g.countryDB.Lookup(ip, &r); err != nil {
+				level.Debug(logger).Log("msg", "error when lookup country", "ip", ip, "err", err)
+			}
+			g.countries[countryKey{country: r.Country.IsoCode, outbound: d.Outbound()}] += n
+		}
+		if g.asnDB != nil {
+			var r asnRecord
+			if err := g.asnDB.Lookup(ip, &r); err != nil {
+				level.Debug(logger).Log("msg", "error when lookup asn", "ip", ip, "err", err)
+			}
+			k := asnKey{org: r.Organization}
+			if r.Number != 0 {
+				k.asn = strconv.FormatUint(uint64(r.Number), 10)
+			}
+			if _, ok := g.asns[k]; !ok && len(g.asns) >= maxASNs {
+				k = asnKey{asn: otherASNs}
+			}
+			g.asns[k] += n
+		}
+	}
+}
+
+func (g *GeoTraffic) Describe(descs chan<- *prometheus.Desc) {
+	descs <- destinationCountryBytes
+	descs <- destinationASNBytes
+}
+
+func (g *GeoTraffic) Collect(metrics chan<- prometheus.Metric) {
+	for _, db := range []*GeoDatabase{g.countryDB, g.asnDB} {
+		if db != nil {
+			db.Refresh()
+		}
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for k, n := range g.countries {
+		metrics <- prometheus.MustNewConstMetric(destinationCountryBytes, prometheus.CounterValue, float64(n), k.country, k.outbound)
+	}
+	for k, n := range g.asns {
+		metrics <- prometheus.MustNewConstMetric(destinationASNBytes, prometheus.CounterValue, float64(n), k.asn, k.org)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encodeMMDB encodes v in the data section format of MaxMind DB, supporting the types used by the tests.
+func encodeMMDB(buf *bytes.Buffer, v interface{}) {
+	control := func(typ byte, size int) {
+		sizeBits, extra := byte(size), []byte{}
+		if size >= 29 {
+			sizeBits, extra = 29, []byte{byte(size - 29)}
+		}
+		if typ > 7 {
+			buf.WriteByte(sizeBits)
+			buf.WriteByte(typ - 7)
+		} else {
+			buf.WriteByte(typ<<5 | sizeBits)
+		}
+		buf.Write(extra)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		control(5, 2)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		control(6, 4)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		control(9, 8)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case []string:
+		control(11, len(v))
+		for _, s := range v {
+			encodeMMDB(buf, s)
+		}
+	case map[string]interface{}:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMMDB(buf, k)
+			encodeMMDB(buf, v[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+// writeTestMMDB writes an IPv4 MaxMind DB with 24-bit records mapping the networks to their records.
+func writeTestMMDB(t *testing.T, path, databaseType string, networks map[string]map[string]interface{}) {
+	type record struct {
+		node int
+		data int // offset in the data section, or -1
+	}
+	empty := record{node: -1, data: -1}
+	nodes := [][2]record{{empty, empty}}
+	data := &bytes.Buffer{}
+	for cidr, v := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := data.Len()
+		encodeMMDB(data, v)
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{node: -1, data: offset}
+				break
+			}
+			if nodes[node][bit].node < 0 {
+				nodes = append(nodes, [2]record{empty, empty})
+				nodes[node][bit] = record{node: len(nodes) - 1, data: -1}
+			}
+			node = nodes[node][bit].node
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		for _, r := range n {
+			value := len(nodes)
+			if r.node >= 0 {
+				value = r.node
+			} else if r.data >= 0 {
+				value = len(nodes) + 16 + r.data
+			}
+			buf.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(buf, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               databaseType,
+		"description":                 map[string]interface{}{"en": databaseType},
+		"ip_version":                  uint16(4),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoTraffic(t *testing.T) {
+	dir := t.TempDir()
+	countryFile := filepath.Join(dir, "Country.mmdb")
+	asnFile := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeTestMMDB(t, countryFile, "GeoLite2-Country", map[string]map[string]interface{}{
+		"1.0.0.0/8":  {"country": map[string]interface{}{"iso_code": "AU"}},
+		"8.8.0.0/16": {"country": map[string]interface{}{"iso_code": "US"}},
+	})
+	writeTestMMDB(t, asnFile, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"8.8.8.0/24": {"autonomous_system_number": uint32(15169), "autonomous_system_organization": "GOOGLE"},
+	})
+	countryDB := NewGeoDatabase(countryFile)
+	g := NewGeoTraffic(countryDB, NewGeoDatabase(asnFile))
+
+	delta := func(ip string, n int64, outbound string) *ConnectionDelta {
+		info := newTrackerInfo(ip, 0, 0, "Match", "", outbound)
+		info.Metadata.DstIP = net.ParseIP(ip)
+		return &ConnectionDelta{TrackerInfo: info, Download: n}
+	}
+	g.ObserveConnections([]*ConnectionDelta{
+		delta("1.1.1.1", 10, "DIRECT"),
+		delta("8.8.8.8", 20, "HK"),
+		delta("8.8.4.4", 30, "HK"),
+		delta("192.168.1.1", 40, "DIRECT"),
+	})
+
+	// The country database is replaced on disk.
+	writeTestMMDB(t, countryFile, "GeoLite2-Country", map[string]map[string]interface{}{
+		"1.0.0.0/8": {"country": map[string]interface{}{"iso_code": "CN"}},
+	})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(countryFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	countryDB.Refresh()
+	g.ObserveConnections([]*ConnectionDelta{delta("1.1.1.1", 5, "DIRECT")})
+
+	expected := `
+# HELP clash_destination_asn_bytes_total Number of bytes transferred with destinations in the autonomous system.
+# TYPE clash_destination_asn_bytes_total counter
+clash_destination_asn_bytes_total{asn="",org=""} 85
+clash_destination_asn_bytes_total{asn="15169",org="GOOGLE"} 20
+# HELP clash_destination_country_bytes_total Number of bytes transferred with destinations in the country through the outbound.
+# TYPE clash_destination_country_bytes_total counter
+clash_destination_country_bytes_total{country="",outbound="DIRECT"} 40
+clash_destination_country_bytes_total{country="AU",outbound="DIRECT"} 10
+clash_destination_country_bytes_total{country="CN",outbound="DIRECT"} 5
+clash_destination_country_bytes_total{country="US",outbound="HK"} 50
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoDatabaseReplacedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Country.mmdb")
+	mtime := time.Unix(1700000000, 0)
+	write := func(path, country string) {
+		writeTestMMDB(t, path, "GeoLite2-Country", map[string]map[string]interface{}{
+			"1.0.0.0/8": {"country": map[string]interface{}{"iso_code": country}},
+		})
+		// Keep the modification time, as a copy preserving it would.
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func(db *GeoDatabase) string {
+		var r countryRecord
+		if err := db.Lookup(net.ParseIP("1.1.1.1"), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r.Country.IsoCode
+	}
+	write(path, "AU")
+	db := NewGeoDatabase(path)
+	if country := lookup(db); country != "AU" {
+		t.Fatalf("expected AU, got %q", country)
+	}
+
+	// The database is replaced by a file of the same size and modification time.
+	replacement := filepath.Join(dir, "Country.mmdb.new")
+	write(replacement, "CN")
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	db.Refresh()
+	if country := lookup(db); country != "CN" {
+		t.Errorf("expected the replaced database to be loaded, got %q", country)
+	}
+}
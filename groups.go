@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	groupSelected = prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "selected"), "The proxy currently selected by the group.", []string{"group", "proxy"}, nil)
+	groupMember   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "member"), "The proxy is a member of the group.", []string{"group", "proxy"}, nil)
+	groupSwitches = prometheus.NewDesc(prometheus.BuildFQName(namespace, "group", "switches_total"), "Number of times the group switched its selected proxy between polls.", []string{"group"}, nil)
+)
+
+// GroupTracker exports the topology of proxy groups and counts how often they switch.
+type GroupTracker struct {
+	mutex    sync.Mutex
+	selected map[string]string
+	switches map[string]int
+	groups   []*Proxy
+}
+
+func NewGroupTracker() *GroupTracker {
+	return &GroupTracker{
+		selected: make(map[string]string),
+		switches: make(map[string]int),
+	}
+}
+
+// Update records the groups in proxies and counts the groups whose selected proxy changed.
+// Groups that are no longer reported are dropped.
+func (g *GroupTracker) Update(proxies map[string]*Proxy) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.groups = g.groups[:0]
+	for _, p := range proxies {
+		if len(p.All) == 0 {
+			continue
+		}
+		g.groups = append(g.groups, p)
+		if prev, ok := g.selected[p.Name]; ok && prev != p.Now {
+			g.switches[p.Name]++
+		} else if !ok {
+			g.switches[p.Name] = 0
+		}
+		g.selected[p.Name] = p.Now
+	}
+	for name := range g.selected {
+		if p, ok := proxies[name]; !ok || len(p.All) == 0 {
+			delete(g.selected, name)
+			delete(g.switches, name)
+		}
+	}
+}
+
+func (g *GroupTracker) Describe(descs chan<- *prometheus.Desc) {
+	descs <- groupSelected
+	descs <- groupMember
+	descs <- groupSwitches
+}
+
+func (g *GroupTracker) Collect(metrics chan<- prometheus.Metric) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, p := range g.groups {
+		if p.Now != "" {
+			metrics <- prometheus.MustNewConstMetric(groupSelected, prometheus.GaugeValue, 1, p.Name, p.Now)
+		}
+		members := make(map[string]struct{}, len(p.All))
+		for _, member := range p.All {
+			if _, ok := members[member]; ok {
+				continue
+			}
+			members[member] = struct{}{}
+			metrics <- prometheus.MustNewConstMetric(groupMember, prometheus.GaugeValue, 1, p.Name, member)
+		}
+	}
+	for name, n := range g.switches {
+		metrics <- prometheus.MustNewConstMetric(groupSwitches, prometheus.CounterValue, float64(n), name)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestGroupTrackerSwitches(t *testing.T) {
+	g := NewGroupTracker()
+	for _, now := range []string{"HK", "HK", "JP", "HK"} {
+		g.Update(map[string]*Proxy{
+			"Auto": {Type: "URLTest", Name: "Auto", Now: now, All: []string{"HK", "JP"}},
+			"HK":   {Type: "Shadowsocks", Name: "HK"},
+			"JP":   {Type: "Shadowsocks", Name: "JP"},
+		})
+	}
+	expected := `
+# HELP clash_group_selected The proxy currently selected by the group.
+# TYPE clash_group_selected gauge
+clash_group_selected{group="Auto",proxy="HK"} 1
+# HELP clash_group_switches_total Number of times the group switched its selected proxy between polls.
+# TYPE clash_group_switches_total counter
+clash_group_switches_total{group="Auto"} 2
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected), "clash_group_selected", "clash_group_switches_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGroupTrackerRemoved(t *testing.T) {
+	g := NewGroupTracker()
+	g.Update(map[string]*Proxy{
+		"Auto":   {Type: "URLTest", Name: "Auto", Now: "HK", All: []string{"HK"}},
+		"Select": {Type: "Selector", Name: "Select", Now: "HK", All: []string{"HK"}},
+		"HK":     {Type: "Shadowsocks", Name: "HK"},
+	})
+	g.Update(map[string]*Proxy{
+		"Auto": {Type: "URLTest", Name: "Auto", Now: "HK", All: []string{"HK"}},
+		"HK":   {Type: "Shadowsocks", Name: "HK"},
+	})
+	expected := `
+# HELP clash_group_member The proxy is a member of the group.
+# TYPE clash_group_member gauge
+clash_group_member{group="Auto",proxy="HK"} 1
+# HELP clash_group_selected The proxy currently selected by the group.
+# TYPE clash_group_selected gauge
+clash_group_selected{group="Auto",proxy="HK"} 1
+# HELP clash_group_switches_total Number of times the group switched its selected proxy between polls.
+# TYPE clash_group_switches_total counter
+clash_group_switches_total{group="Auto"} 0
+`
+	if err := testutil.CollectAndCompare(g, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
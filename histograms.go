@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	DefaultConnectionDurationBuckets = prometheus.ExponentialBuckets(0.1, 4, 10)
+	DefaultConnectionBytesBuckets    = prometheus.ExponentialBuckets(1024, 4, 12)
+)
+
+// ConnectionHistograms observes the lifetime and the bytes of connections when they are closed.
+// The lifetime ends at the snapshot that misses the connection, so it is up to a poll interval too long.
+type ConnectionHistograms struct {
+	duration *prometheus.HistogramVec
+	bytes    *prometheus.HistogramVec
+}
+
+// NewConnectionHistograms returns ConnectionHistograms with the given classic buckets.
+// Native histograms are exposed as well if nativeBucketFactor is greater than 1.
+func NewConnectionHistograms(durationBuckets, bytesBuckets []float64, nativeBucketFactor float64) *ConnectionHistograms {
+	return &ConnectionHistograms{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                   namespace,
+			Subsystem:                   "connection",
+			Name:                        "duration_seconds",
+			Help:                        "Lifetime of closed connections.",
+			Buckets:                     durationBuckets,
+			NativeHistogramBucketFactor: nativeBucketFactor,
+		}, []string{"outbound"}),
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                   namespace,
+			Subsystem:                   "connection",
+			Name:                        "bytes",
+			Help:                        "Number of bytes uploaded and downloaded by closed connections.",
+			Buckets:                     bytesBuckets,
+			NativeHistogramBucketFactor: nativeBucketFactor,
+		}, []string{"outbound"}),
+	}
+}
+
+func (h *ConnectionHistograms) ObserveConnections(deltas []*ConnectionDelta) {
+	for _, d := range deltas {
+		if !d.Closed || d.Start.IsZero() {
+			continue
+		}
+		outbound := d.Outbound()
+		h.duration.WithLabelValues(outbound).Observe(d.Time.Sub(d.Start).Seconds())
+		h.bytes.WithLabelValues(outbound).Observe(float64(d.UploadTotal + d.DownloadTotal))
+	}
+}
+
+func (h *ConnectionHistograms) Describe(descs chan<- *prometheus.Desc) {
+	h.duration.Describe(descs)
+	h.bytes.Describe(descs)
+}
+
+func (h *ConnectionHistograms) Collect(metrics chan<- prometheus.Metric) {
+	h.duration.Collect(metrics)
+	h.bytes.Collect(metrics)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionHistograms(t *testing.T) {
+	h := NewConnectionHistograms([]float64{60, 600}, []float64{100, 1000}, 0)
+	tracker := NewConnectionTracker(h)
+	start := time.Unix(1600000000, 0)
+	tracker.Update(&Snapshot{
+		UploadTotal:   30,
+		DownloadTotal: 300,
+		Connections: []*TrackerInfo{
+			newTrackerInfo("a", 10, 100, "Match", "", "DIRECT"),
+			newTrackerInfo("b", 20, 200, "Match", "", "DIRECT"),
+		},
+	}, start.Add(100*time.Second))
+	// a is closed after transferring 10 more bytes.
+	tracker.Update(&Snapshot{
+		UploadTotal:   30,
+		DownloadTotal: 310,
+		Connections: []*TrackerInfo{
+			newTrackerInfo("b", 20, 200, "Match", "", "DIRECT"),
+		},
+	}, start.Add(120*time.Second))
+
+	expected := `
+# HELP clash_connection_bytes Number of bytes uploaded and downloaded by closed connections.
+# TYPE clash_connection_bytes histogram
+clash_connection_bytes_bucket{outbound="DIRECT",le="100"} 0
+clash_connection_bytes_bucket{outbound="DIRECT",le="1000"} 1
+clash_connection_bytes_bucket{outbound="DIRECT",le="+Inf"} 1
+clash_connection_bytes_sum{outbound="DIRECT"} 120
+clash_connection_bytes_count{outbound="DIRECT"} 1
+# HELP clash_connection_duration_seconds Lifetime of closed connections.
+# TYPE clash_connection_duration_seconds histogram
+clash_connection_duration_seconds_bucket{outbound="DIRECT",le="60"} 0
+clash_connection_duration_seconds_bucket{outbound="DIRECT",le="600"} 1
+clash_connection_duration_seconds_bucket{outbound="DIRECT",le="+Inf"} 1
+clash_connection_duration_seconds_sum{outbound="DIRECT"} 120
+clash_connection_duration_seconds_count{outbound="DIRECT"} 1
+`
+	if err := testutil.CollectAndCompare(h, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
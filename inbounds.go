@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var inboundBytes = prometheus.NewDesc(prometheus.BuildFQName(namespace, "inbound", "bytes_total"), "Number of bytes transferred by connections accepted by the inbound for the authenticated user.", []string{"inbound", "user", "direction"}, nil)
+
+type inboundKey struct {
+	inbound string
+	user    string
+}
+
+// InboundTraffic accounts connection deltas to the inbound listener and the authenticated user.
+// Without the inbound name reported by Clash.Meta, the inbound is the type of the connection, e.g. HTTP.
+type InboundTraffic struct {
+	mutex    sync.Mutex
+	inbounds map[inboundKey]*byteCounter
+}
+
+func NewInboundTraffic() *InboundTraffic {
+	return &InboundTraffic{inbounds: make(map[inboundKey]*byteCounter)}
+}
+
+func (i *InboundTraffic) ObserveConnections(deltas []*ConnectionDelta) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for _, d := range deltas {
+		if (d.Upload == 0 && d.Download == 0) || d.Metadata == nil {
+			continue
+		}
+		k := inboundKey{inbound: d.Metadata.InboundName, user: d.Metadata.InboundUser}
+		if k.inbound == "" {
+			k.inbound = d.Metadata.Type
+		}
+		c, ok := i.inbounds[k]
+		if !ok {
+			c = &byteCounter{}
+			i.inbounds[k] = c
+		}
+		c.add(d)
+	}
+}
+
+func (i *InboundTraffic) Describe(descs chan<- *prometheus.Desc) {
+	descs <- inboundBytes
+}
+
+func (i *InboundTraffic) Collect(metrics chan<- prometheus.Metric) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for k, c := range i.inbounds {
+		metrics <- prometheus.MustNewConstMetric(inboundBytes, prometheus.CounterValue, float64(c.Download), k.inbound, k.user, "download")
+		metrics <- prometheus.MustNewConstMetric(inboundBytes, prometheus.CounterValue, float64(c.Upload), k.inbound, k.user, "upload")
+	}
+}
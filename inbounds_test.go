@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboundTraffic(t *testing.T) {
+	var s Snapshot
+	if err := json.Unmarshal([]byte(`{"downloadTotal":300,"uploadTotal":30,"connections":[
+{"id":"a","metadata":{"network":"tcp","type":"Socks5","inboundName":"DEFAULT-SOCKS","inboundIP":"192.168.1.2","inboundPort":"7891","inboundUser":"alice"},"upload":10,"download":100,"chains":["DIRECT"],"rule":"Match"},
+{"id":"b","metadata":{"network":"tcp","type":"Socks5","inboundName":"DEFAULT-SOCKS","inboundIP":"192.168.1.2","inboundPort":"7891","inboundUser":"bob"},"upload":20,"download":150,"chains":["DIRECT"],"rule":"Match"},
+{"id":"c","metadata":{"network":"tcp","type":"HTTP"},"upload":0,"download":50,"chains":["DIRECT"],"rule":"Match"}]}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Connections[0].Metadata; m.InboundName != "DEFAULT-SOCKS" || m.InboundPort != "7891" || m.InboundIP.String() != "192.168.1.2" || m.InboundUser != "alice" {
+		t.Fatalf("unexpected inbound metadata: %+v", m)
+	}
+	inbounds := NewInboundTraffic()
+	tracker := NewConnectionTracker(inbounds)
+	tracker.Update(&Snapshot{}, time.Now())
+	tracker.Update(&s, time.Now())
+
+	expected := `
+# HELP clash_inbound_bytes_total Number of bytes transferred by connections accepted by the inbound for the authenticated user.
+# TYPE clash_inbound_bytes_total counter
+clash_inbound_bytes_total{direction="download",inbound="DEFAULT-SOCKS",user="alice"} 100
+clash_inbound_bytes_total{direction="download",inbound="DEFAULT-SOCKS",user="bob"} 150
+clash_inbound_bytes_total{direction="download",inbound="HTTP",user=""} 50
+clash_inbound_bytes_total{direction="upload",inbound="DEFAULT-SOCKS",user="alice"} 10
+clash_inbound_bytes_total{direction="upload",inbound="DEFAULT-SOCKS",user="bob"} 20
+clash_inbound_bytes_total{direction="upload",inbound="HTTP",user=""} 0
+`
+	if err := testutil.CollectAndCompare(inbounds, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
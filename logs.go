@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/url"
+	"regexp"
+)
+
+var (
+	// see clash/tunnel/tunnel.go and mihomo/tunnel/tunnel.go, e.g.
+	// [TCP] dial Proxy (match DomainSuffix/google.com) 192.168.1.2:50000 --> www.google.com:443 error: dial tcp 1.2.3.4:443: i/o timeout
+	dialErrorWithRule = regexp.MustCompile(`^\[(?:TCP|UDP)\] dial (.+) \(match [^()]*\) .* error: `)
+	// [TCP] dial DIRECT 192.168.1.2:50000 --> www.google.com:443 error: connect failed
+	dialError = regexp.MustCompile(`^\[(?:TCP|UDP)\] dial (.+?) \S+ --> \S+ error: `)
+	// classic Clash before the source address was logged, e.g.
+	// [TCP] dial Proxy to www.google.com:443 error: dial tcp 1.2.3.4:443: i/o timeout
+	dialErrorClassic = regexp.MustCompile(`^\[(?:TCP|UDP)\] dial (.+?)(?: \(match [^()]*\))? to \S+ error: `)
+)
+
+type LogEntry struct {
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+}
+
+// DialErrorProxy returns the proxy name of a dial error log, or false if the log is not a dial error.
+func (l *LogEntry) DialErrorProxy() (string, bool) {
+	for _, re := range []*regexp.Regexp{dialErrorWithRule, dialError, dialErrorClassic} {
+		if m := re.FindStringSubmatch(l.Payload); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// LogsUrl returns the url of the log stream with messages at or above level.
+func LogsUrl(level string) *url.URL {
+	return &url.URL{Path: "/logs", RawQuery: url.Values{"level": []string{level}}.Encode()}
+}
+
+// LogMonitor counts the messages of the /logs stream.
+type LogMonitor struct {
+	messages   *prometheus.CounterVec
+	dialErrors *prometheus.CounterVec
+}
+
+func NewLogMonitor() *LogMonitor {
+	return &LogMonitor{
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "log",
+			Name:      "messages_total",
+			Help:      "Number of log messages streamed by Clash.",
+		}, []string{"level"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "proxy",
+			Name:      "dial_errors_total",
+			Help:      "Number of dial errors of the proxy logged by Clash.",
+		}, []string{"proxy"}),
+	}
+}
+
+func (m *LogMonitor) HandleLog(data []byte) error {
+	l := new(LogEntry)
+	if err := json.Unmarshal(data, l); err != nil {
+		return err
+	}
+	m.messages.WithLabelValues(l.Type).Inc()
+	if proxy, ok := l.DialErrorProxy(); ok {
+		m.dialErrors.WithLabelValues(proxy).Inc()
+	}
+	return nil
+}
+
+func (m *LogMonitor) Describe(descs chan<- *prometheus.Desc) {
+	m.messages.Describe(descs)
+	m.dialErrors.Describe(descs)
+}
+
+func (m *LogMonitor) Collect(metrics chan<- prometheus.Metric) {
+	m.messages.Collect(metrics)
+	m.dialErrors.Collect(metrics)
+}
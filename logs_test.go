@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+)
+
+func TestDialErrorProxy(t *testing.T) {
+	for _, tt := range []struct {
+		payload string
+		proxy   string
+		ok      bool
+	}{
+		{payload: "[TCP] dial Proxy (match DomainSuffix/google.com) 192.168.1.2:50000 --> www.google.com:443 error: dial tcp 1.2.3.4:443: i/o timeout", proxy: "Proxy", ok: true},
+		{payload: "[UDP] dial 🇭🇰 HK 01 (match GeoIP/CN) 192.168.1.2:50000 --> 8.8.8.8:53 error: context deadline exceeded", proxy: "🇭🇰 HK 01", ok: true},
+		{payload: "[TCP] dial DIRECT 192.168.1.2:50000 --> www.google.com:443 error: connect failed", proxy: "DIRECT", ok: true},
+		{payload: "[TCP] dial HK 01 192.168.1.2:50000 --> www.google.com:443 error: connect failed", proxy: "HK 01", ok: true},
+		{payload: "[TCP] dial Proxy to www.google.com:443 error: dial tcp 1.2.3.4:443: i/o timeout", proxy: "Proxy", ok: true},
+		{payload: "[UDP] dial HK 01 (match GeoIP/CN) to 8.8.8.8:53 error: context deadline exceeded", proxy: "HK 01", ok: true},
+		{payload: "[TCP] 192.168.1.2:50000 --> www.google.com:443 match DomainSuffix(google.com) using Proxy[HK 01]", ok: false},
+		{payload: "[DNS] resolve www.google.com error: all DNS requests failed", ok: false},
+	} {
+		l := &LogEntry{Type: "warning", Payload: tt.payload}
+		if proxy, ok := l.DialErrorProxy(); proxy != tt.proxy || ok != tt.ok {
+			t.Errorf("DialErrorProxy(%q) = %q, %v, want %q, %v", tt.payload, proxy, ok, tt.proxy, tt.ok)
+		}
+	}
+}
+
+func TestLogMonitor(t *testing.T) {
+	m := NewLogMonitor()
+	for _, data := range []string{
+		`{"type":"warning","payload":"[TCP] dial Proxy (match Match/) 192.168.1.2:50000 --> www.google.com:443 error: i/o timeout"}`,
+		`{"type":"warning","payload":"[TCP] dial Proxy (match Match/) 192.168.1.2:50001 --> www.google.com:443 error: i/o timeout"}`,
+		`{"type":"error","payload":"[DNS] resolve www.google.com error: all DNS requests failed"}`,
+	} {
+		if err := m.HandleLog([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.HandleLog([]byte(`not json`)); err == nil {
+		t.Error("expected an error for invalid log")
+	}
+	expected := `
+# HELP clash_log_messages_total Number of log messages streamed by Clash.
+# TYPE clash_log_messages_total counter
+clash_log_messages_total{level="error"} 1
+clash_log_messages_total{level="warning"} 2
+# HELP clash_proxy_dial_errors_total Number of dial errors of the proxy logged by Clash.
+# TYPE clash_proxy_dial_errors_total counter
+clash_proxy_dial_errors_total{proxy="Proxy"} 2
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
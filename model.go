@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"math"
 	"net"
+	"regexp"
 	"time"
 )
 
@@ -11,26 +13,59 @@ type Version struct {
 	Version string `json:"version"`
 }
 
-// see clash/constant/adapters.go#AdapterType.String
+// see clash/constant/adapters.go#AdapterType.String and mihomo/constant/adapters.go#AdapterType.String
 var (
-	ConnectionProxyTypes   = []string{"Shadowsocks", "ShadowsocksR", "Snell", "Socks5", "Http", "Vmess", "Trojan"}
-	RuleProxyTypes         = []string{"Direct", "Reject", "Relay", "Selector", "Fallback", "URLTest", "LoadBalance"}
-	AllProxyTypes          []string
-	connectionProxyTypeSet = make(map[string]struct{}, len(ConnectionProxyTypes))
+	ConnectionProxyTypes = []string{"Shadowsocks", "ShadowsocksR", "Snell", "Socks5", "Http", "Vmess", "Vless", "Trojan", "Hysteria", "Hysteria2", "Tuic", "WireGuard", "Ssh", "Mieru"}
+	// GroupProxyTypes are the types that do not connect to a remote server by themselves.
+	GroupProxyTypes   = []string{"Selector", "URLTest", "Fallback", "LoadBalance", "Relay", "Direct", "Reject", "RejectDrop", "Pass", "Compatible", "Dns"}
+	AllProxyTypes     []string
+	groupProxyTypeSet = make(map[string]struct{}, len(GroupProxyTypes))
 )
 
 func init() {
 	AllProxyTypes = append(AllProxyTypes, ConnectionProxyTypes...)
-	AllProxyTypes = append(AllProxyTypes, RuleProxyTypes...)
+	AllProxyTypes = append(AllProxyTypes, GroupProxyTypes...)
 
-	for _, t := range ConnectionProxyTypes {
-		connectionProxyTypeSet[t] = struct{}{}
+	for _, t := range GroupProxyTypes {
+		groupProxyTypeSet[t] = struct{}{}
 	}
 }
 
+// IsConnectionProxy reports whether proxy is a leaf proxy, i.e. neither a group nor a builtin,
+// so that unknown types added by Clash forks are treated as leaf proxies.
 func IsConnectionProxy(proxy *Proxy) bool {
-	_, ok := connectionProxyTypeSet[proxy.Type]
-	return ok
+	if len(proxy.All) > 0 {
+		return false
+	}
+	_, ok := groupProxyTypeSet[proxy.Type]
+	return !ok
+}
+
+// ProxyClassifier overrides IsConnectionProxy for specific proxy types and names.
+type ProxyClassifier struct {
+	// IncludeTypes are always treated as leaf proxies.
+	IncludeTypes []string
+	// ExcludeTypes are never treated as leaf proxies.
+	ExcludeTypes []string
+	// ExcludeNames excludes leaf proxies whose name matches it, e.g. the traffic info nodes of subscriptions.
+	ExcludeNames *regexp.Regexp
+}
+
+func (c *ProxyClassifier) IsConnectionProxy(proxy *Proxy) bool {
+	if c.ExcludeNames != nil && c.ExcludeNames.MatchString(proxy.Name) {
+		return false
+	}
+	for _, t := range c.ExcludeTypes {
+		if t == proxy.Type {
+			return false
+		}
+	}
+	for _, t := range c.IncludeTypes {
+		if t == proxy.Type {
+			return true
+		}
+	}
+	return IsConnectionProxy(proxy)
 }
 
 const MaxDelay = math.MaxUint16
@@ -54,12 +89,61 @@ const (
 	VehicleTypeCompatible = "Compatible"
 )
 
+// SubscriptionInfo is decoded from the subscription-userinfo header of the provider by Clash.Meta.
+type SubscriptionInfo struct {
+	Upload   int64 `json:"Upload"`
+	Download int64 `json:"Download"`
+	Total    int64 `json:"Total"`
+	// Expire is a unix timestamp, 0 if the subscription never expires.
+	Expire int64 `json:"Expire"`
+}
+
 type Provider struct {
-	Type        string    `json:"type"`
+	Type             string            `json:"type"`
+	Name             string            `json:"name"`
+	VehicleType      string            `json:"vehicleType"`
+	UpdatedAt        time.Time         `json:"updatedAt"`
+	Proxies          []*Proxy          `json:"proxies"`
+	SubscriptionInfo *SubscriptionInfo `json:"subscriptionInfo"`
+}
+
+type Rule struct {
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+	// Proxy is the proxy or group the rule routes to.
+	Proxy string `json:"proxy"`
+}
+
+type RuleProvider struct {
 	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Behavior    string    `json:"behavior"`
 	VehicleType string    `json:"vehicleType"`
+	RuleCount   int       `json:"ruleCount"`
 	UpdatedAt   time.Time `json:"updatedAt"`
-	Proxies     []*Proxy  `json:"proxies"`
+}
+
+type Tun struct {
+	Enable bool `json:"enable"`
+}
+
+// Configs is the running configuration returned by /configs.
+type Configs struct {
+	Port        int    `json:"port"`
+	SocksPort   int    `json:"socks-port"`
+	RedirPort   int    `json:"redir-port"`
+	TProxyPort  int    `json:"tproxy-port"`
+	MixedPort   int    `json:"mixed-port"`
+	AllowLan    bool   `json:"allow-lan"`
+	BindAddress string `json:"bind-address"`
+	Mode        string `json:"mode"`
+	LogLevel    string `json:"log-level"`
+	IPv6        bool   `json:"ipv6"`
+	// Authentication holds the "user:pass" of the inbound authentication.
+	Authentication []string `json:"authentication"`
+	Tun            *Tun     `json:"tun"`
+	// Raw is the payload the configs are decoded from.
+	Raw json.RawMessage `json:"-"`
 }
 
 type Metadata struct {
@@ -71,6 +155,16 @@ type Metadata struct {
 	DstPort  string `json:"destinationPort"`
 	AddrType int    `json:"-"`
 	Host     string `json:"host"`
+	// Process, ProcessPath and Uid are reported by Clash.Meta when it finds the local process of the connection.
+	Process     string `json:"process"`
+	ProcessPath string `json:"processPath"`
+	Uid         uint32 `json:"uid"`
+	// InboundName, InboundIP, InboundPort and InboundUser are reported by Clash.Meta for the listener
+	// that accepted the connection and the user it authenticated.
+	InboundName string `json:"inboundName"`
+	InboundIP   net.IP `json:"inboundIP"`
+	InboundPort string `json:"inboundPort"`
+	InboundUser string `json:"inboundUser"`
 }
 
 type TrackerInfo struct {
@@ -84,6 +178,15 @@ type TrackerInfo struct {
 	RulePayload   string    `json:"rulePayload"`
 }
 
+// Outbound returns the proxy that carried the connection.
+// Clash orders chains from the outbound proxy to the group matched by the rule.
+func (t *TrackerInfo) Outbound() string {
+	if len(t.Chain) == 0 {
+		return ""
+	}
+	return t.Chain[0]
+}
+
 type Snapshot struct {
 	DownloadTotal int64          `json:"downloadTotal"`
 	UploadTotal   int64          `json:"uploadTotal"`
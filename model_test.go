@@ -0,0 +1,35 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestIsConnectionProxy(t *testing.T) {
+	classifier := &ProxyClassifier{
+		IncludeTypes: []string{"Relay"},
+		ExcludeTypes: []string{"Ssh"},
+		ExcludeNames: regexp.MustCompile("^Traffic:"),
+	}
+	for _, tt := range []struct {
+		proxy    *Proxy
+		expected bool
+		override bool
+	}{
+		{proxy: &Proxy{Type: "Vless", Name: "JP"}, expected: true, override: true},
+		{proxy: &Proxy{Type: "AnyTLS", Name: "SG"}, expected: true, override: true},
+		{proxy: &Proxy{Type: "Selector", Name: "GLOBAL", All: []string{"JP"}}, expected: false, override: false},
+		{proxy: &Proxy{Type: "Smart", Name: "Auto", All: []string{"JP"}}, expected: false, override: false},
+		{proxy: &Proxy{Type: "Direct", Name: "DIRECT"}, expected: false, override: false},
+		{proxy: &Proxy{Type: "Relay", Name: "Chain"}, expected: false, override: true},
+		{proxy: &Proxy{Type: "Ssh", Name: "Bastion"}, expected: true, override: false},
+		{proxy: &Proxy{Type: "Trojan", Name: "Traffic: 10 GB"}, expected: true, override: false},
+	} {
+		if rv := IsConnectionProxy(tt.proxy); rv != tt.expected {
+			t.Errorf("IsConnectionProxy(%s %q) = %v, want %v", tt.proxy.Type, tt.proxy.Name, rv, tt.expected)
+		}
+		if rv := classifier.IsConnectionProxy(tt.proxy); rv != tt.override {
+			t.Errorf("ProxyClassifier.IsConnectionProxy(%s %q) = %v, want %v", tt.proxy.Type, tt.proxy.Name, rv, tt.override)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// probeTargetIdleTimeout is how long the Exporter of a target keeps probing without /probe requests.
+	probeTargetIdleTimeout = 10 * time.Minute
+	// probeTargetSweepInterval is how often Exporters of idle targets are looked for.
+	probeTargetSweepInterval = time.Minute
+	// maxProbeTargets is the maximum number of targets with a running Exporter.
+	maxProbeTargets = 100
+)
+
+type probeTargetKey struct {
+	module *Module
+	target string
+}
+
+type probeTarget struct {
+	exporter *Exporter
+	registry *prometheus.Registry
+	cancel   context.CancelFunc
+	lastUsed time.Time
+}
+
+type probeHandler struct {
+	conf          *Config
+	defaultModule *Module
+	opts          []ExporterOption
+	maxTargets    int
+
+	mutex   sync.Mutex
+	targets map[probeTargetKey]*probeTarget
+}
+
+// ProbeHandler serves metrics of the Clash instance given by the target query parameter,
+// in the style of the blackbox exporter. The module query parameter selects the settings
+// from conf, and defaultModule is used when it is omitted. Only the targets allowed by the
+// module are probed. opts are applied to every Exporter.
+//
+// Every target and module keeps its Exporter running in the background, so that proxy delays
+// are probed on the schedule of the prober and served from its cache rather than on every request.
+// At most maxProbeTargets Exporters run at once, and those of targets that are not requested for
+// probeTargetIdleTimeout are stopped. All of them are stopped when ctx is done.
+func ProbeHandler(ctx context.Context, conf *Config, defaultModule *Module, opts ...ExporterOption) http.Handler {
+	h := &probeHandler{
+		conf:          conf,
+		defaultModule: defaultModule,
+		opts:          opts,
+		maxTargets:    maxProbeTargets,
+		targets:       make(map[probeTargetKey]*probeTarget),
+	}
+	go h.run(ctx)
+	return h
+}
+
+// run stops the Exporters of idle targets every probeTargetSweepInterval until ctx is done.
+func (h *probeHandler) run(ctx context.Context) {
+	ticker := time.NewTicker(probeTargetSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			h.evict(func(*probeTarget) bool { return true })
+			return
+		case now := <-ticker.C:
+			h.evictIdle(now)
+		}
+	}
+}
+
+// evictIdle stops the Exporters of targets that are not requested for probeTargetIdleTimeout at now.
+func (h *probeHandler) evictIdle(now time.Time) {
+	h.evict(func(t *probeTarget) bool { return now.Sub(t.lastUsed) > probeTargetIdleTimeout })
+}
+
+func (h *probeHandler) evict(match func(*probeTarget) bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key, t := range h.targets {
+		if match(t) {
+			t.cancel()
+			delete(h.targets, key)
+		}
+	}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module := h.defaultModule
+	if name := params.Get("module"); name != "" {
+		var ok bool
+		if h.conf != nil {
+			module, ok = h.conf.Modules[name]
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown module %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if !module.AllowsTarget(target) {
+		http.Error(w, fmt.Sprintf("target %q is not allowed by the targets of the module", target), http.StatusForbidden)
+		return
+	}
+
+	h.mutex.Lock()
+	key := probeTargetKey{module: module, target: target}
+	t, ok := h.targets[key]
+	if !ok {
+		if len(h.targets) >= h.maxTargets {
+			h.mutex.Unlock()
+			http.Error(w, fmt.Sprintf("too many probe targets, at most %d are probed at once", h.maxTargets), http.StatusServiceUnavailable)
+			return
+		}
+		client, err := NewClient(target, module.Secret, WithTransportConfig(&module.TransportConfig))
+		if err != nil {
+			h.mutex.Unlock()
+			http.Error(w, fmt.Sprintf("invalid target %q: %s", target, err), http.StatusBadRequest)
+			return
+		}
+		e, err := NewExporter(client, module.TestUrl, module.TestUrlTimeout, h.opts...)
+		if err != nil {
+			h.mutex.Unlock()
+			level.Error(logger).Log("msg", "error when create exporter", "target", target, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go e.Run(ctx)
+		t = &probeTarget{exporter: e, registry: prometheus.NewRegistry(), cancel: cancel}
+		t.registry.MustRegister(e)
+		h.targets[key] = t
+	}
+	t.lastUsed = time.Now()
+	h.mutex.Unlock()
+
+	promhttp.HandlerFor(t.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log/level"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProbeInterval = 1 * time.Minute
+	DefaultProbeJitter   = 10 * time.Second
+)
+
+var errNotProbed = errors.New("proxy delays have not been probed yet")
+
+type delayResult struct {
+	Type     string
+	Name     string
+	Provider string
+	Delay    uint16
+	Time     time.Time
+}
+
+// DelayProber measures proxy delays on its own schedule and caches the results,
+// so that scrapes never trigger delay tests against the proxies.
+type DelayProber struct {
+	client         IClient
+	classifier     *ProxyClassifier
+	testUrl        string
+	testUrlTimeout time.Duration
+	interval       time.Duration
+	jitter         time.Duration
+
+	mutex            sync.RWMutex
+	proxies          []*delayResult
+	providersProxies []*delayResult
+	proxiesErr       error
+	providersErr     error
+}
+
+func NewDelayProber(client IClient, classifier *ProxyClassifier, testUrl string, testUrlTimeout, interval, jitter time.Duration) *DelayProber {
+	return &DelayProber{
+		client:         client,
+		classifier:     classifier,
+		testUrl:        testUrl,
+		testUrlTimeout: testUrlTimeout,
+		interval:       interval,
+		jitter:         jitter,
+		proxiesErr:     errNotProbed,
+		providersErr:   errNotProbed,
+	}
+}
+
+// Run probes immediately and then once every interval plus a random jitter until ctx is done.
+func (p *DelayProber) Run(ctx context.Context) {
+	for {
+		p.Probe()
+		wait := p.interval
+		if p.jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(p.jitter)))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Probe runs a single round of delay tests and updates the cache.
+func (p *DelayProber) Probe() {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		results, err := p.probeProxies()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if err == nil {
+			p.proxies = results
+		}
+		p.proxiesErr = err
+	}()
+	go func() {
+		defer wg.Done()
+		results, err := p.probeProvidersProxies()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if err == nil {
+			p.providersProxies = results
+		}
+		p.providersErr = err
+	}()
+	wg.Wait()
+}
+
+// Proxies returns the cached delays of proxies that are not from a provider and the error of the last probe.
+func (p *DelayProber) Proxies() ([]*delayResult, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.proxies, p.proxiesErr
+}
+
+// ProvidersProxies returns the cached delays of provider proxies and the error of the last probe.
+func (p *DelayProber) ProvidersProxies() ([]*delayResult, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.providersProxies, p.providersErr
+}
+
+func (p *DelayProber) probeProxies() ([]*delayResult, error) {
+	proxies, err := p.client.GetProxies()
+	if err != nil {
+		return nil, err
+	}
+	delays := GetAllProxyDelay(proxies, p.classifier.IsConnectionProxy, p.client, p.testUrl, p.testUrlTimeout)
+	now := time.Now()
+	results := make([]*delayResult, 0, len(delays))
+	for proxyName, delay := range delays {
+		proxy := proxies[proxyName]
+		results = append(results, &delayResult{Type: proxy.Type, Name: proxy.Name, Delay: delay, Time: now})
+	}
+	return results, nil
+}
+
+func (p *DelayProber) probeProvidersProxies() ([]*delayResult, error) {
+	providers, err := p.client.GetProvidersProxies()
+	if err != nil {
+		return nil, err
+	}
+	wg := sync.WaitGroup{}
+	count := 0
+	for _, provider := range providers {
+		if provider.VehicleType == VehicleTypeHTTP || provider.VehicleType == VehicleTypeFile {
+			wg.Add(1)
+			count += 1
+			go func(provider *Provider) {
+				defer wg.Done()
+				if err := p.client.ProviderProxiesHealthCheck(provider.Name); err != nil {
+					level.Error(logger).Log("msg", "error when do health check", "err", err, "provider", provider.Name)
+				}
+			}(provider)
+		}
+	}
+	wg.Wait()
+	if count == 0 {
+		level.Info(logger).Log("msg", "no provider do health check")
+		return nil, nil
+	}
+
+	providers, err = p.client.GetProvidersProxies()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*delayResult, 0)
+	for _, provider := range providers {
+		if provider.VehicleType == VehicleTypeHTTP || provider.VehicleType == VehicleTypeFile {
+			for _, proxy := range provider.Proxies {
+				if p.classifier.IsConnectionProxy(proxy) {
+					n := len(proxy.History)
+					if n >= 1 && time.Since(proxy.History[n-1].Time) <= 1*time.Minute {
+						delay := proxy.History[n-1].Delay
+						if delay == 0 {
+							delay = MaxDelay
+						}
+						results = append(results, &delayResult{Type: proxy.Type, Name: proxy.Name, Provider: provider.Name, Delay: delay, Time: proxy.History[n-1].Time})
+					} else {
+						level.Error(logger).Log("msg", "provider proxy should have at least one history", "proxy", proxy.Name, "providerName", provider.Name)
+					}
+				}
+			}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingClient counts the probes and fails them when down is set.
+type countingClient struct {
+	testClient
+
+	mutex  sync.Mutex
+	probes int
+	down   bool
+}
+
+func (c *countingClient) GetProxies() (map[string]*Proxy, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.probes++
+	if c.down {
+		return nil, errUnavailable
+	}
+	return c.testClient.GetProxies()
+}
+
+func (c *countingClient) GetProvidersProxies() (map[string]*Provider, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.down {
+		return nil, errUnavailable
+	}
+	return map[string]*Provider{}, nil
+}
+
+func (c *countingClient) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.probes
+}
+
+func TestDelayProberRun(t *testing.T) {
+	client := &countingClient{}
+	p := NewDelayProber(client, &ProxyClassifier{}, DefaultTestUrl, DefaultTestUrlTimeout, 20*time.Millisecond, 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("prober did not stop after the context was cancelled")
+	}
+
+	// The first probe runs right away, the others every 20ms to 30ms.
+	n := client.count()
+	if n < 3 || n > 6 {
+		t.Errorf("expected 3 to 6 probes in 100ms, got %d", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if client.count() != n {
+		t.Errorf("expected no probes after the prober stopped, got %d more", client.count()-n)
+	}
+}
+
+func TestDelayProberCache(t *testing.T) {
+	client := &countingClient{}
+	p := NewDelayProber(client, &ProxyClassifier{}, DefaultTestUrl, DefaultTestUrlTimeout, time.Minute, 0)
+	if _, err := p.Proxies(); err != errNotProbed {
+		t.Errorf("expected %v before the first probe, got %v", errNotProbed, err)
+	}
+	if _, err := p.ProvidersProxies(); err != errNotProbed {
+		t.Errorf("expected %v before the first probe, got %v", errNotProbed, err)
+	}
+
+	p.Probe()
+	proxies, err := p.Proxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := client.testClient.GetProxies()
+	expected := 0
+	for _, proxy := range all {
+		if (&ProxyClassifier{}).IsConnectionProxy(proxy) {
+			expected++
+		}
+	}
+	if len(proxies) != expected {
+		t.Errorf("expected %d probed proxies, got %d", expected, len(proxies))
+	}
+	for _, r := range proxies {
+		if r.Delay != 666 {
+			t.Errorf("%s: expected delay 666, got %d", r.Name, r.Delay)
+		}
+	}
+	if providersProxies, err := p.ProvidersProxies(); err != nil || len(providersProxies) != 0 {
+		t.Errorf("expected no provider proxies, got %v, %v", providersProxies, err)
+	}
+	// Reading the cache does not probe.
+	if n := client.count(); n != 1 {
+		t.Errorf("expected 1 probe, got %d", n)
+	}
+
+	// A failed probe keeps the previous delays and reports its error.
+	client.mutex.Lock()
+	client.down = true
+	client.mutex.Unlock()
+	p.Probe()
+	cached, err := p.Proxies()
+	if err != errUnavailable {
+		t.Errorf("expected %v after a failed probe, got %v", errUnavailable, err)
+	}
+	if len(cached) != len(proxies) {
+		t.Errorf("expected the %d delays of the previous probe, got %d", len(proxies), len(cached))
+	}
+	if _, err := p.ProvidersProxies(); err != errUnavailable {
+		t.Errorf("expected %v after a failed probe, got %v", errUnavailable, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var (
+	processDownloadBytes     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "process", "download_bytes_total"), "Number of bytes downloaded by connections of the local process.", []string{"process"}, nil)
+	processUploadBytes       = prometheus.NewDesc(prometheus.BuildFQName(namespace, "process", "upload_bytes_total"), "Number of bytes uploaded by connections of the local process.", []string{"process"}, nil)
+	processConnectionsActive = prometheus.NewDesc(prometheus.BuildFQName(namespace, "process", "connections_active"), "Number of open connections of the local process.", []string{"process"}, nil)
+)
+
+// ProcessName renames the processes whose path, or name without a path, matches Regex to Name,
+// in which $1 and the like are replaced with the submatches.
+type ProcessName struct {
+	Regex string `yaml:"regex"`
+	Name  string `yaml:"name"`
+
+	re *regexp.Regexp
+}
+
+func (p *ProcessName) compile() (err error) {
+	p.re, err = regexp.Compile(p.Regex)
+	return err
+}
+
+// NormalizeProcess returns the name of the process of m by the first matching of names,
+// or the name reported by Clash, e.g. to fold versioned paths into stable names.
+func NormalizeProcess(names []*ProcessName, m *Metadata) string {
+	s := m.ProcessPath
+	if s == "" {
+		s = m.Process
+	}
+	for _, n := range names {
+		if match := n.re.FindStringSubmatchIndex(s); match != nil {
+			return string(n.re.ExpandString(nil, n.Name, s, match))
+		}
+	}
+	if m.Process == "" && m.ProcessPath != "" {
+		return filepath.Base(m.ProcessPath)
+	}
+	return m.Process
+}
+
+// ProcessTraffic accounts connection deltas to the local process reported by Clash.Meta,
+// which is only known for connections from the host running Clash, e.g. in TUN mode.
+type ProcessTraffic struct {
+	names []*ProcessName
+
+	mutex     sync.Mutex
+	processes map[string]*byteCounter
+	active    map[string]int
+}
+
+func NewProcessTraffic(names []*ProcessName) *ProcessTraffic {
+	return &ProcessTraffic{
+		names:     names,
+		processes: make(map[string]*byteCounter),
+		active:    make(map[string]int),
+	}
+}
+
+func (p *ProcessTraffic) ObserveConnections(deltas []*ConnectionDelta) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.active = make(map[string]int)
+	for _, d := range deltas {
+		if d.Metadata == nil || (d.Metadata.Process == "" && d.Metadata.ProcessPath == "") {
+			continue
+		}
+		process := NormalizeProcess(p.names, d.Metadata)
+		if !d.Closed {
+			p.active[process]++
+		}
+		if d.Upload == 0 && d.Download == 0 {
+			continue
+		}
+		c, ok := p.processes[process]
+		if !ok {
+			c = &byteCounter{}
+			p.processes[process] = c
+		}
+		c.add(d)
+	}
+}
+
+func (p *ProcessTraffic) Describe(descs chan<- *prometheus.Desc) {
+	descs <- processDownloadBytes
+	descs <- processUploadBytes
+	descs <- processConnectionsActive
+}
+
+func (p *ProcessTraffic) Collect(metrics chan<- prometheus.Metric) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for process, c := range p.processes {
+		metrics <- prometheus.MustNewConstMetric(processDownloadBytes, prometheus.CounterValue, float64(c.Download), process)
+		metrics <- prometheus.MustNewConstMetric(processUploadBytes, prometheus.CounterValue, float64(c.Upload), process)
+	}
+	for process, n := range p.active {
+		metrics <- prometheus.MustNewConstMetric(processConnectionsActive, prometheus.GaugeValue, float64(n), process)
+	}
+}
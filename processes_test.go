@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessTraffic(t *testing.T) {
+	conf, err := LoadConfig("test/config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessTraffic(conf.ProcessNames)
+	tracker := NewConnectionTracker(p)
+	now := time.Unix(1600000100, 0)
+	conn := func(uuid string, download int64, process, path string) *TrackerInfo {
+		info := newTrackerInfo(uuid, 0, download, "Match", "", "DIRECT")
+		info.Metadata.Process, info.Metadata.ProcessPath = process, path
+		return info
+	}
+
+	tracker.Update(&Snapshot{}, now.Add(-time.Second))
+	tracker.Update(&Snapshot{Connections: []*TrackerInfo{
+		conn("a", 100, "Google Chrome Helper", "/Applications/Google Chrome.app/Contents/Frameworks/Google Chrome Helper (Renderer).app/Contents/MacOS/Google Chrome Helper (Renderer)"),
+		conn("b", 200, "Google Chrome Helper", "/Applications/Google Chrome.app/Contents/Frameworks/Google Chrome Helper (GPU).app/Contents/MacOS/Google Chrome Helper (GPU)"),
+		conn("c", 300, "curl", "/nix/store/3x7dwzq8abc-curl-8.4.0/bin/curl"),
+		conn("d", 400, "", "/usr/bin/wget"),
+		conn("e", 500, "", ""),
+	}}, now)
+	tracker.Update(&Snapshot{Connections: []*TrackerInfo{
+		conn("b", 250, "Google Chrome Helper", "/Applications/Google Chrome.app/Contents/Frameworks/Google Chrome Helper (GPU).app/Contents/MacOS/Google Chrome Helper (GPU)"),
+	}}, now.Add(time.Second))
+
+	expected := `
+# HELP clash_process_connections_active Number of open connections of the local process.
+# TYPE clash_process_connections_active gauge
+clash_process_connections_active{process="Google Chrome"} 1
+# HELP clash_process_download_bytes_total Number of bytes downloaded by connections of the local process.
+# TYPE clash_process_download_bytes_total counter
+clash_process_download_bytes_total{process="Google Chrome"} 350
+clash_process_download_bytes_total{process="curl"} 300
+clash_process_download_bytes_total{process="wget"} 400
+# HELP clash_process_upload_bytes_total Number of bytes uploaded by connections of the local process.
+# TYPE clash_process_upload_bytes_total counter
+clash_process_upload_bytes_total{process="Google Chrome"} 0
+clash_process_upload_bytes_total{process="curl"} 0
+clash_process_upload_bytes_total{process="wget"} 0
+`
+	if err := testutil.CollectAndCompare(p, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var (
+	ruleProviderRules   = prometheus.NewDesc(prometheus.BuildFQName(namespace, "rule_provider", "rules"), "Number of rules of the rule provider.", []string{"provider", "behavior", "vehicle"}, nil)
+	ruleProviderUpdated = prometheus.NewDesc(prometheus.BuildFQName(namespace, "rule_provider", "updated_timestamp_seconds"), "Unix time the rule provider was last updated.", []string{"provider"}, nil)
+)
+
+// RuleProviderRefresher asks Clash to update HTTP rule providers older than maxAge.
+type RuleProviderRefresher struct {
+	client IClient
+	maxAge time.Duration
+
+	mutex     sync.Mutex
+	inflight  map[string]bool
+	refreshes *prometheus.CounterVec
+}
+
+func NewRuleProviderRefresher(client IClient, maxAge time.Duration) *RuleProviderRefresher {
+	return &RuleProviderRefresher{
+		client:   client,
+		maxAge:   maxAge,
+		inflight: make(map[string]bool),
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "rule_provider",
+			Name:      "refreshes_total",
+			Help:      "Number of updates of stale rule providers triggered by the exporter.",
+		}, []string{"provider", "result"}),
+	}
+}
+
+// Refresh updates the stale providers in the background, at most one update per provider at a time.
+func (r *RuleProviderRefresher) Refresh(providers map[string]*RuleProvider, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range providers {
+		if p.VehicleType != VehicleTypeHTTP || now.Sub(p.UpdatedAt) <= r.maxAge || r.inflight[p.Name] {
+			continue
+		}
+		r.inflight[p.Name] = true
+		go r.update(p)
+	}
+}
+
+func (r *RuleProviderRefresher) update(p *RuleProvider) {
+	level.Info(logger).Log("msg", "updating stale rule provider", "provider", p.Name, "updatedAt", p.UpdatedAt)
+	result := "success"
+	if err := r.client.UpdateRuleProvider(p.Name); err != nil {
+		level.Error(logger).Log("msg", "error when update rule provider", "provider", p.Name, "err", err)
+		result = "failure"
+	}
+	r.refreshes.WithLabelValues(p.Name, result).Inc()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.inflight, p.Name)
+}
+
+func (r *RuleProviderRefresher) Describe(descs chan<- *prometheus.Desc) {
+	r.refreshes.Describe(descs)
+}
+
+func (r *RuleProviderRefresher) Collect(metrics chan<- prometheus.Metric) {
+	r.refreshes.Collect(metrics)
+}
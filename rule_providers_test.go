@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ruleProviderClient struct {
+	testClient
+	updated chan string
+}
+
+func (c *ruleProviderClient) UpdateRuleProvider(providerName string) error {
+	c.updated <- providerName
+	return nil
+}
+
+func TestRuleProviderRefresher(t *testing.T) {
+	client := &ruleProviderClient{updated: make(chan string)}
+	r := NewRuleProviderRefresher(client, 24*time.Hour)
+	providers, _ := client.GetProvidersRules()
+	now := time.Unix(1618000000, 0).Add(25 * time.Hour)
+
+	r.Refresh(providers, now)
+	// The update of geosite is still in flight, so it is not started again.
+	r.Refresh(providers, now)
+	select {
+	case name := <-client.updated:
+		if name != "geosite" {
+			t.Errorf("expected geosite to be updated, got %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	select {
+	case name := <-client.updated:
+		t.Errorf("unexpected update of %s", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expected := `
+# HELP clash_rule_provider_refreshes_total Number of updates of stale rule providers triggered by the exporter.
+# TYPE clash_rule_provider_refreshes_total counter
+clash_rule_provider_refreshes_total{provider="geosite",result="success"} 1
+`
+	if err := testutil.CollectAndCompare(r, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	controllerUnauthenticated = prometheus.NewDesc(prometheus.BuildFQName(namespace, "security", "controller_unauthenticated"), "Whether the external controller answers requests without a secret.", nil, nil)
+	allowLanWithoutAuth       = prometheus.NewDesc(prometheus.BuildFQName(namespace, "security", "allow_lan_without_auth"), "Whether Clash accepts connections from the LAN without inbound authentication.", nil, nil)
+	controllerPublicBind      = prometheus.NewDesc(prometheus.BuildFQName(namespace, "security", "controller_public_bind"), "Whether the external controller listens on a non-loopback address.", nil, nil)
+)
+
+const (
+	publicBindDialTimeout = 300 * time.Millisecond
+	// publicBindTTL is how long the exposure of the external controller is cached.
+	publicBindTTL = 10 * time.Minute
+)
+
+// IsPublicController reports whether the external controller at u is reachable on a non-loopback address.
+// When u is a loopback address, the controller is dialed on the addresses of the local interfaces,
+// which tells whether it listens on all interfaces if the exporter runs next to Clash.
+func IsPublicController(u *url.URL) bool {
+	if u.Scheme == "unix" {
+		return false
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return true
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if isListening(ipNet.IP, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func isListening(ip net.IP, port string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), publicBindDialTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// publicBindCache remembers the result of IsPublicController, which resolves names and dials local addresses,
+// until publicBindTTL passes.
+type publicBindCache struct {
+	mutex   sync.Mutex
+	checked time.Time
+	public  bool
+}
+
+func (c *publicBindCache) IsPublic(u *url.URL, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.checked.IsZero() || now.Sub(c.checked) >= publicBindTTL {
+		c.public = IsPublicController(u)
+		c.checked = now
+	}
+	return c.public
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *Exporter) scrapeSecurity(metrics chan<- prometheus.Metric) error {
+	unauthenticated, err := e.Client.IsUnauthenticated()
+	if err != nil {
+		return err
+	}
+	metrics <- prometheus.MustNewConstMetric(controllerUnauthenticated, prometheus.GaugeValue, boolToFloat(unauthenticated))
+	return nil
+}
+
+// collectConfigsSecurity exports the security checks derived from /configs, which is fetched by scrapeConfigs.
+func (e *Exporter) collectConfigsSecurity(configs *Configs, metrics chan<- prometheus.Metric) {
+	metrics <- prometheus.MustNewConstMetric(allowLanWithoutAuth, prometheus.GaugeValue, boolToFloat(configs.AllowLan && len(configs.Authentication) == 0))
+	public := e.publicBind.IsPublic(e.Client.ControllerUrl(), time.Now())
+	metrics <- prometheus.MustNewConstMetric(controllerPublicBind, prometheus.GaugeValue, boolToFloat(public))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIsUnauthenticated(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		srv := newFakeClash(t, secret)
+		c, err := NewClient(srv.URL, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unauthenticated, err := c.IsUnauthenticated()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unauthenticated != (secret == "") {
+			t.Errorf("secret %q: expected unauthenticated %v, got %v", secret, secret == "", unauthenticated)
+		}
+	}
+}
+
+func TestIsPublicController(t *testing.T) {
+	// A port nothing listens on, so that loopback controllers are not reachable on other interfaces.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	for controller, expected := range map[string]bool{
+		"unix:///var/run/clash.sock":             false,
+		"http://127.0.0.1:" + strconv.Itoa(port): false,
+		"http://[::1]:" + strconv.Itoa(port):     false,
+		"http://0.0.0.0:9090":                    true,
+		"http://192.168.1.1:9090":                true,
+		"https://[2001:db8::1]":                  true,
+	} {
+		u, err := url.Parse(controller)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := IsPublicController(u); actual != expected {
+			t.Errorf("%s: expected %v, got %v", controller, expected, actual)
+		}
+	}
+}
+
+func TestPublicBindCache(t *testing.T) {
+	loopback, err := url.Parse("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := url.Parse("http://192.168.1.1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := publicBindCache{}
+	now := time.Unix(1600000000, 0)
+	if c.IsPublic(loopback, now) {
+		t.Error("expected a loopback controller without listeners on the local interfaces not to be public")
+	}
+	// The controller is not checked again until the cached result expires.
+	if c.IsPublic(public, now.Add(publicBindTTL-time.Second)) {
+		t.Error("expected the cached result")
+	}
+	if !c.IsPublic(public, now.Add(publicBindTTL)) {
+		t.Error("expected the result to be checked again after the TTL")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log/level"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultStreamMinBackoff = 1 * time.Second
+	DefaultStreamMaxBackoff = 1 * time.Minute
+)
+
+// StreamSubscriber keeps a stream of the external controller open and
+// reconnects with exponential backoff when it breaks.
+type StreamSubscriber struct {
+	client     IClient
+	url        *url.URL
+	handle     func(data []byte) error
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// onReconnect is called before each reconnection if not nil.
+	onReconnect func(err error)
+}
+
+func NewStreamSubscriber(client IClient, u *url.URL, handle func(data []byte) error) *StreamSubscriber {
+	return &StreamSubscriber{
+		client:     client,
+		url:        u,
+		handle:     handle,
+		minBackoff: DefaultStreamMinBackoff,
+		maxBackoff: DefaultStreamMaxBackoff,
+	}
+}
+
+// Run subscribes the stream until ctx is done, or gives up when Clash does not serve it, e.g. /memory before Clash.Meta.
+func (s *StreamSubscriber) Run(ctx context.Context) {
+	backoff := s.minBackoff
+	for {
+		received := false
+		err := s.client.Stream(ctx, s.url, func(data []byte) error {
+			received = true
+			return s.handle(data)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if e, ok := err.(*StatusError); ok && e.StatusCode == http.StatusNotFound {
+			level.Warn(logger).Log("msg", "stream is not supported by Clash, giving up", "stream", s.url.Path)
+			return
+		}
+		if received {
+			backoff = s.minBackoff
+		}
+		level.Warn(logger).Log("msg", "stream is broken, reconnecting", "stream", s.url.Path, "backoff", backoff, "err", err)
+		if s.onReconnect != nil {
+			s.onReconnect(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamSubscriber(t *testing.T) {
+	connections := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+		n := connections
+		for i := 1; i <= 3; i++ {
+			_, _ = fmt.Fprintf(w, "{\"up\":%d,\"down\":%d}\n", n*i, n*i*10)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewTrafficMonitor(DefaultTrafficPeakWindow)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := 0
+	s := NewStreamSubscriber(client, trafficUrl, func(data []byte) error {
+		if err := m.HandleTraffic(data); err != nil {
+			return err
+		}
+		received++
+		if received == 5 {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	})
+	s.minBackoff = time.Millisecond
+	reconnects := 0
+	s.onReconnect = func(error) { reconnects++ }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for traffic, received %d", received)
+	}
+	if reconnects != 1 {
+		t.Errorf("expected 1 reconnection, got %d", reconnects)
+	}
+
+	// The peak of the second connection is 2*3 up and 2*3*10 down, the current value is 2*2.
+	expected := `
+# HELP clash_traffic_peak_rate_bytes_per_second Peak traffic rate streamed by Clash over the peak window.
+# TYPE clash_traffic_peak_rate_bytes_per_second gauge
+clash_traffic_peak_rate_bytes_per_second{direction="down"} 40
+clash_traffic_peak_rate_bytes_per_second{direction="up"} 4
+# HELP clash_traffic_rate_bytes_per_second Current traffic rate streamed by Clash.
+# TYPE clash_traffic_rate_bytes_per_second gauge
+clash_traffic_rate_bytes_per_second{direction="down"} 40
+clash_traffic_rate_bytes_per_second{direction="up"} 4
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamSubscriberNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	client, err := NewClient(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStreamSubscriber(client, memoryUrl, func([]byte) error { return nil })
+	s.minBackoff = time.Millisecond
+	reconnects := 0
+	s.onReconnect = func(error) { reconnects++ }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber kept retrying a stream that is not served")
+	}
+	if reconnects != 0 {
+		t.Errorf("expected no reconnection, got %d", reconnects)
+	}
+}
+
+func TestTrafficMonitorPeak(t *testing.T) {
+	m := NewTrafficMonitor(DefaultTrafficPeakWindow)
+	now := time.Unix(1600000000, 0)
+	m.now = func() time.Time { return now }
+	for _, data := range []string{`{"up":10,"down":500}`, `{"up":30,"down":100}`, `{"up":20,"down":200}`} {
+		if err := m.HandleTraffic([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(20 * time.Second)
+	}
+	expected := `
+# HELP clash_traffic_peak_rate_bytes_per_second Peak traffic rate streamed by Clash over the peak window.
+# TYPE clash_traffic_peak_rate_bytes_per_second gauge
+clash_traffic_peak_rate_bytes_per_second{direction="down"} %d
+clash_traffic_peak_rate_bytes_per_second{direction="up"} %d
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(fmt.Sprintf(expected, 500, 30)), "clash_traffic_peak_rate_bytes_per_second"); err != nil {
+		t.Error(err)
+	}
+	// Scrapes do not reset the peak.
+	if err := testutil.CollectAndCompare(m, strings.NewReader(fmt.Sprintf(expected, 500, 30)), "clash_traffic_peak_rate_bytes_per_second"); err != nil {
+		t.Error(err)
+	}
+	// The first sample leaves the window, the second one follows.
+	now = now.Add(time.Second)
+	if err := testutil.CollectAndCompare(m, strings.NewReader(fmt.Sprintf(expected, 200, 30)), "clash_traffic_peak_rate_bytes_per_second"); err != nil {
+		t.Error(err)
+	}
+	now = now.Add(20 * time.Second)
+	if err := testutil.CollectAndCompare(m, strings.NewReader(fmt.Sprintf(expected, 200, 20)), "clash_traffic_peak_rate_bytes_per_second"); err != nil {
+		t.Error(err)
+	}
+}
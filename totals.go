@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	restartsDetected = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "restarts_detected_total"), "Number of Clash restarts detected from the traffic totals and connections.", nil, nil)
+	processStartTime = prometheus.NewDesc(prometheus.BuildFQName(namespace, "process", "start_time_seconds"), "Estimated start time of Clash since unix epoch in seconds, known after a restart was detected.", nil, nil)
+)
+
+// totalsState is the state of TrafficTotals that is persisted across exporter restarts.
+type totalsState struct {
+	// DownloadOffset and UploadOffset are the bytes accumulated by previous Clash processes.
+	DownloadOffset int64 `json:"download_offset"`
+	UploadOffset   int64 `json:"upload_offset"`
+	// LastDownload and LastUpload are the totals of the last snapshot.
+	LastDownload int64     `json:"last_download"`
+	LastUpload   int64     `json:"last_upload"`
+	Restarts     int64     `json:"restarts"`
+	StartTime    time.Time `json:"start_time,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const (
+	DefaultStateSaveInterval = 1 * time.Minute
+	// restartSlack is the excess of the bytes of new connections over the growth of the totals that is not taken for
+	// a restart, as Clash reads the bytes of the connections slightly after the totals of a snapshot.
+	restartSlack = 1 << 20
+)
+
+// TrafficTotals turns the traffic totals of Clash, which start over when Clash restarts,
+// into monotonic counters. A restart is detected when a total decreases, or when none of the
+// connections of the last snapshot remain and the totals grew less than the bytes of the current
+// connections, which all opened since then otherwise. The bytes transferred between the last
+// snapshot and the restart are lost then.
+type TrafficTotals struct {
+	stateFile    string
+	saveInterval time.Duration
+
+	mutex       sync.Mutex
+	state       totalsState
+	initialized bool
+	// connections are the IDs of the connections of the last snapshot, nil until this process saw one.
+	connections map[string]bool
+	saved       time.Time
+}
+
+func NewTrafficTotals() *TrafficTotals {
+	return &TrafficTotals{}
+}
+
+// LoadTrafficTotals returns TrafficTotals persisted to stateFile at most every saveInterval and on restarts
+// of Clash, starting from the state in stateFile if it exists.
+func LoadTrafficTotals(stateFile string, saveInterval time.Duration) (*TrafficTotals, error) {
+	t := &TrafficTotals{stateFile: stateFile, saveInterval: saveInterval}
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.state); err != nil {
+		return nil, err
+	}
+	t.initialized = true
+	return t, nil
+}
+
+// Update accounts the totals of s taken at now.
+func (t *TrafficTotals) Update(s *Snapshot, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	restarted := t.initialized && t.restarted(s)
+	if restarted {
+		t.state.DownloadOffset += t.state.LastDownload
+		t.state.UploadOffset += t.state.LastUpload
+		t.state.Restarts++
+		// Clash started after the previous snapshot and before its oldest connection.
+		start := now
+		for _, c := range s.Connections {
+			if c.Start.Before(start) {
+				start = c.Start
+			}
+		}
+		if start.Before(t.state.UpdatedAt) {
+			start = t.state.UpdatedAt
+		}
+		t.state.StartTime = start
+		level.Info(logger).Log("msg", "clash restart detected", "startTime", start)
+	}
+	t.state.LastDownload = s.DownloadTotal
+	t.state.LastUpload = s.UploadTotal
+	t.state.UpdatedAt = now
+	t.initialized = true
+	t.connections = make(map[string]bool, len(s.Connections))
+	for _, c := range s.Connections {
+		t.connections[c.UUID] = true
+	}
+	if t.stateFile != "" && (restarted || now.Sub(t.saved) >= t.saveInterval) {
+		if err := t.save(); err != nil {
+			level.Warn(logger).Log("msg", "error when save traffic totals", "file", t.stateFile, "err", err)
+		}
+		t.saved = now
+	}
+}
+
+// restarted reports whether s was taken from another Clash process than the last snapshot.
+func (t *TrafficTotals) restarted(s *Snapshot) bool {
+	if s.DownloadTotal < t.state.LastDownload || s.UploadTotal < t.state.LastUpload {
+		return true
+	}
+	if t.connections == nil {
+		return false
+	}
+	var download, upload int64
+	for _, c := range s.Connections {
+		if t.connections[c.UUID] {
+			return false
+		}
+		download += c.DownloadTotal
+		upload += c.UploadTotal
+	}
+	return s.DownloadTotal-t.state.LastDownload+restartSlack < download || s.UploadTotal-t.state.LastUpload+restartSlack < upload
+}
+
+// Save persists the state to the state file, e.g. on shutdown, as updates are only saved every saveInterval.
+func (t *TrafficTotals) Save() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stateFile == "" || !t.initialized {
+		return nil
+	}
+	return t.save()
+}
+
+// save writes the state to a temporary file renamed over stateFile, so that it is never partially written.
+func (t *TrafficTotals) save() error {
+	data, err := json.Marshal(&t.state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(t.stateFile), filepath.Base(t.stateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), t.stateFile)
+}
+
+func (t *TrafficTotals) Describe(descs chan<- *prometheus.Desc) {
+	descs <- downloadTotal
+	descs <- uploadTotal
+	descs <- restartsDetected
+	descs <- processStartTime
+}
+
+func (t *TrafficTotals) Collect(metrics chan<- prometheus.Metric) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	metrics <- prometheus.MustNewConstMetric(downloadTotal, prometheus.CounterValue, float64(t.state.DownloadOffset+t.state.LastDownload))
+	metrics <- prometheus.MustNewConstMetric(uploadTotal, prometheus.CounterValue, float64(t.state.UploadOffset+t.state.LastUpload))
+	metrics <- prometheus.MustNewConstMetric(restartsDetected, prometheus.CounterValue, float64(t.state.Restarts))
+	if !t.state.StartTime.IsZero() {
+		metrics <- prometheus.MustNewConstMetric(processStartTime, prometheus.GaugeValue, float64(t.state.StartTime.UnixNano())/1e9)
+	}
+}
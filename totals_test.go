@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficTotals(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	totals, err := LoadTrafficTotals(stateFile, DefaultStateSaveInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	totals.Update(&Snapshot{UploadTotal: 10, DownloadTotal: 100}, now)
+	totals.Update(&Snapshot{UploadTotal: 20, DownloadTotal: 200}, now.Add(time.Minute))
+
+	// The exporter restarts, then Clash restarts and has a connection opened 10s before the poll.
+	totals, err = LoadTrafficTotals(stateFile, DefaultStateSaveInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newTrackerInfo("a", 1, 10, "Match", "", "DIRECT")
+	conn.Start = now.Add(2 * time.Minute)
+	totals.Update(&Snapshot{UploadTotal: 5, DownloadTotal: 50, Connections: []*TrackerInfo{conn}}, now.Add(2*time.Minute+10*time.Second))
+
+	expected := `
+# HELP clash_connection_download_total Number of bytes that downloaded by clash.
+# TYPE clash_connection_download_total counter
+clash_connection_download_total 250
+# HELP clash_connection_upload_total Number of bytes that uploaded by clash.
+# TYPE clash_connection_upload_total counter
+clash_connection_upload_total 25
+# HELP clash_process_start_time_seconds Estimated start time of Clash since unix epoch in seconds, known after a restart was detected.
+# TYPE clash_process_start_time_seconds gauge
+clash_process_start_time_seconds 1.60000012e+09
+# HELP clash_restarts_detected_total Number of Clash restarts detected from the traffic totals and connections.
+# TYPE clash_restarts_detected_total counter
+clash_restarts_detected_total 1
+`
+	if err := testutil.CollectAndCompare(totals, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrafficTotalsSaveInterval(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	totals, err := LoadTrafficTotals(stateFile, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	totals.Update(&Snapshot{DownloadTotal: 100}, now)
+	totals.Update(&Snapshot{DownloadTotal: 200}, now.Add(time.Minute))
+	load := func() int64 {
+		loaded, err := LoadTrafficTotals(stateFile, 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loaded.state.LastDownload
+	}
+	// The second update is within the save interval of the first one.
+	if last := load(); last != 100 {
+		t.Errorf("expected the totals of the first update to be saved, got %d", last)
+	}
+	if err := totals.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if last := load(); last != 200 {
+		t.Errorf("expected the totals of the last update to be saved, got %d", last)
+	}
+}
+
+func TestTrafficTotalsReplacedConnections(t *testing.T) {
+	totals := NewTrafficTotals()
+	now := time.Unix(1600000000, 0)
+	totals.Update(&Snapshot{DownloadTotal: 10 << 20, Connections: []*TrackerInfo{newTrackerInfo("a", 0, 1<<20, "Match", "")}}, now)
+	// A new connection that transferred less than the growth of the totals is no restart.
+	totals.Update(&Snapshot{DownloadTotal: 12 << 20, Connections: []*TrackerInfo{newTrackerInfo("b", 0, 2<<20, "Match", "")}}, now.Add(time.Minute))
+	// Clash restarted and transferred 3MiB, of which 2.5MiB by a new connection.
+	totals.Update(&Snapshot{DownloadTotal: 13 << 20, Connections: []*TrackerInfo{newTrackerInfo("c", 0, 5<<19, "Match", "")}}, now.Add(2*time.Minute))
+	// Clash still runs: the totals grew more than the bytes of the old connection.
+	totals.Update(&Snapshot{DownloadTotal: 14 << 20, Connections: []*TrackerInfo{newTrackerInfo("c", 0, 3<<20, "Match", "")}}, now.Add(3*time.Minute))
+
+	expected := fmt.Sprintf(`
+# HELP clash_connection_download_total Number of bytes that downloaded by clash.
+# TYPE clash_connection_download_total counter
+clash_connection_download_total %d
+# HELP clash_restarts_detected_total Number of Clash restarts detected from the traffic totals and connections.
+# TYPE clash_restarts_detected_total counter
+clash_restarts_detected_total 1
+`, 26<<20)
+	if err := testutil.CollectAndCompare(totals, strings.NewReader(expected), "clash_connection_download_total", "clash_restarts_detected_total"); err != nil {
+		t.Fatal(err)
+	}
+}
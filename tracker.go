@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionDelta is the change of a connection between two successive snapshots.
+type ConnectionDelta struct {
+	*TrackerInfo
+	// Upload and Download are the bytes transferred since the previous snapshot.
+	Upload   int64
+	Download int64
+	// Opened is set when the connection is seen for the first time.
+	Opened bool
+	// Closed is set when the connection is gone. TrackerInfo then holds its last seen state
+	// plus the estimated bytes transferred after it was last seen.
+	Closed bool
+	// Time is when the snapshot was taken.
+	Time time.Time
+}
+
+// ConnectionObserver receives the connection deltas of every snapshot.
+type ConnectionObserver interface {
+	ObserveConnections(deltas []*ConnectionDelta)
+}
+
+// ConnectionTracker diffs successive snapshots of /connections by TrackerInfo.UUID.
+//
+// Clash only reports the bytes of connections that are still open, so the bytes
+// a connection transferred between the last snapshot it was seen in and its close
+// are estimated from the increase of the global totals that is not explained by
+// the open connections, split among the closed connections by their size.
+//
+// The first snapshot is a baseline: its connections were opened and transferred their bytes
+// before the tracker started, so they are neither opened nor credited with bytes.
+type ConnectionTracker struct {
+	mutex         sync.Mutex
+	conns         map[string]*TrackerInfo
+	downloadTotal int64
+	uploadTotal   int64
+	initialized   bool
+	observers     []ConnectionObserver
+}
+
+func NewConnectionTracker(observers ...ConnectionObserver) *ConnectionTracker {
+	return &ConnectionTracker{
+		conns:     make(map[string]*TrackerInfo),
+		observers: observers,
+	}
+}
+
+// AddObserver registers o to receive the deltas of following snapshots.
+func (t *ConnectionTracker) AddObserver(o ConnectionObserver) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.observers = append(t.observers, o)
+}
+
+// Update diffs s against the previous snapshot and notifies the observers.
+func (t *ConnectionTracker) Update(s *Snapshot, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deltas := make([]*ConnectionDelta, 0, len(s.Connections))
+	conns := make(map[string]*TrackerInfo, len(s.Connections))
+	var liveUpload, liveDownload int64
+	for _, c := range s.Connections {
+		d := &ConnectionDelta{TrackerInfo: c, Upload: c.UploadTotal, Download: c.DownloadTotal, Time: now}
+		if prev, ok := t.conns[c.UUID]; ok {
+			d.Upload = nonNegative(c.UploadTotal - prev.UploadTotal)
+			d.Download = nonNegative(c.DownloadTotal - prev.DownloadTotal)
+		} else if t.initialized {
+			d.Opened = true
+		} else {
+			d.Upload, d.Download = 0, 0
+		}
+		liveUpload += d.Upload
+		liveDownload += d.Download
+		conns[c.UUID] = c
+		deltas = append(deltas, d)
+	}
+
+	closed := make([]*ConnectionDelta, 0)
+	for uuid, prev := range t.conns {
+		if _, ok := conns[uuid]; !ok {
+			c := *prev
+			closed = append(closed, &ConnectionDelta{TrackerInfo: &c, Closed: true, Time: now})
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].UUID < closed[j].UUID })
+	// Totals decrease when Clash restarts, the remaining bytes are unknown then.
+	if t.initialized && len(closed) > 0 && s.UploadTotal >= t.uploadTotal && s.DownloadTotal >= t.downloadTotal {
+		uploads := make([]int64, len(closed))
+		downloads := make([]int64, len(closed))
+		for i, d := range closed {
+			uploads[i] = d.UploadTotal
+			downloads[i] = d.DownloadTotal
+		}
+		uploads = split(s.UploadTotal-t.uploadTotal-liveUpload, uploads)
+		downloads = split(s.DownloadTotal-t.downloadTotal-liveDownload, downloads)
+		for i, d := range closed {
+			d.Upload, d.Download = uploads[i], downloads[i]
+			d.UploadTotal += d.Upload
+			d.DownloadTotal += d.Download
+		}
+	}
+	deltas = append(deltas, closed...)
+
+	t.conns = conns
+	t.uploadTotal = s.UploadTotal
+	t.downloadTotal = s.DownloadTotal
+	t.initialized = true
+	for _, o := range t.observers {
+		o.ObserveConnections(deltas)
+	}
+}
+
+// split divides n into parts proportional to weights, or evenly if all weights are zero.
+func split(n int64, weights []int64) []int64 {
+	parts := make([]int64, len(weights))
+	if n <= 0 || len(weights) == 0 {
+		return parts
+	}
+	var sum int64
+	for _, w := range weights {
+		sum += w
+	}
+	remaining := n
+	for i, w := range weights[:len(weights)-1] {
+		if sum == 0 {
+			parts[i] = n / int64(len(weights))
+		} else {
+			parts[i] = int64(float64(n) * float64(w) / float64(sum))
+		}
+		remaining -= parts[i]
+	}
+	parts[len(parts)-1] = remaining
+	return parts
+}
+
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
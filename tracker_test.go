@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	deltas [][]*ConnectionDelta
+}
+
+func (o *recordingObserver) ObserveConnections(deltas []*ConnectionDelta) {
+	o.deltas = append(o.deltas, deltas)
+}
+
+func newTrackerInfo(uuid string, upload, download int64, rule, payload string, chain ...string) *TrackerInfo {
+	return &TrackerInfo{
+		UUID:          uuid,
+		Metadata:      &Metadata{NetWork: "tcp", Type: "HTTP", Host: uuid + ".example.com"},
+		UploadTotal:   upload,
+		DownloadTotal: download,
+		Start:         time.Unix(1600000000, 0),
+		Chain:         chain,
+		Rule:          rule,
+		RulePayload:   payload,
+	}
+}
+
+func TestConnectionTracker(t *testing.T) {
+	o := &recordingObserver{}
+	accounting := NewTrafficAccounting()
+	tracker := NewConnectionTracker(o, accounting)
+	now := time.Unix(1600000100, 0)
+
+	tracker.Update(&Snapshot{
+		UploadTotal:   30,
+		DownloadTotal: 300,
+		Connections: []*TrackerInfo{
+			newTrackerInfo("a", 10, 100, "DomainSuffix", "google.com", "HK", "Proxy"),
+			newTrackerInfo("b", 20, 200, "Match", "", "DIRECT"),
+		},
+	}, now)
+	// The first snapshot is a baseline of connections opened before the tracker started.
+	if n := len(o.deltas[0]); n != 2 || o.deltas[0][0].Opened || o.deltas[0][0].Download != 0 {
+		t.Fatalf("unexpected deltas of first snapshot: %+v", o.deltas[0])
+	}
+
+	// a transferred 50 more bytes and closed, b transferred 20 more bytes, c is opened.
+	tracker.Update(&Snapshot{
+		UploadTotal:   37,
+		DownloadTotal: 400,
+		Connections: []*TrackerInfo{
+			newTrackerInfo("b", 20, 220, "Match", "", "DIRECT"),
+			newTrackerInfo("c", 5, 30, "DomainSuffix", "google.com", "JP", "Proxy"),
+		},
+	}, now.Add(time.Second))
+	deltas := o.deltas[1]
+	if len(deltas) != 3 {
+		t.Fatalf("expected 3 deltas, got %d", len(deltas))
+	}
+	b, c, a := deltas[0], deltas[1], deltas[2]
+	if b.Opened || b.Closed || b.Download != 20 || b.Upload != 0 {
+		t.Errorf("unexpected delta of b: %+v", b)
+	}
+	if !c.Opened || c.Download != 30 || c.Upload != 5 {
+		t.Errorf("unexpected delta of c: %+v", c)
+	}
+	if !a.Closed || a.Download != 50 || a.DownloadTotal != 150 || a.Upload != 2 || a.UploadTotal != 12 {
+		t.Errorf("unexpected delta of a: %+v", a)
+	}
+
+	expected := `
+# HELP clash_outbound_download_bytes_total Number of bytes downloaded through the outbound proxy.
+# TYPE clash_outbound_download_bytes_total counter
+clash_outbound_download_bytes_total{outbound="DIRECT"} 20
+clash_outbound_download_bytes_total{outbound="HK"} 50
+clash_outbound_download_bytes_total{outbound="JP"} 30
+# HELP clash_rule_download_bytes_total Number of bytes downloaded by connections matching the rule.
+# TYPE clash_rule_download_bytes_total counter
+clash_rule_download_bytes_total{payload="",rule="Match"} 20
+clash_rule_download_bytes_total{payload="google.com",rule="DomainSuffix"} 80
+`
+	if err := testutil.CollectAndCompare(accounting, strings.NewReader(expected), "clash_outbound_download_bytes_total", "clash_rule_download_bytes_total"); err != nil {
+		t.Error(err)
+	}
+
+	// Clash restarted, the bytes of b after the last snapshot are unknown.
+	tracker.Update(&Snapshot{UploadTotal: 1, DownloadTotal: 10}, now.Add(2*time.Second))
+	for _, d := range o.deltas[2] {
+		if !d.Closed || d.Download != 0 || d.Upload != 0 {
+			t.Errorf("unexpected delta after restart: %+v", d)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tt := range []struct {
+		n        int64
+		weights  []int64
+		expected []int64
+	}{
+		{n: 10, weights: []int64{1, 1, 2}, expected: []int64{2, 2, 6}},
+		{n: 10, weights: []int64{0, 0, 0}, expected: []int64{3, 3, 4}},
+		{n: -5, weights: []int64{1, 1}, expected: []int64{0, 0}},
+		{n: 5, weights: nil, expected: []int64{}},
+	} {
+		rv := split(tt.n, tt.weights)
+		if len(rv) != len(tt.expected) {
+			t.Errorf("split(%d, %v) = %v, want %v", tt.n, tt.weights, rv, tt.expected)
+			continue
+		}
+		for i := range rv {
+			if rv[i] != tt.expected[i] {
+				t.Errorf("split(%d, %v) = %v, want %v", tt.n, tt.weights, rv, tt.expected)
+				break
+			}
+		}
+	}
+}
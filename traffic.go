@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// DefaultTrafficPeakWindow is the period over which the peak traffic rate is taken.
+const DefaultTrafficPeakWindow = time.Minute
+
+var (
+	trafficRate     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "traffic", "rate_bytes_per_second"), "Current traffic rate streamed by Clash.", []string{"direction"}, nil)
+	trafficPeakRate = prometheus.NewDesc(prometheus.BuildFQName(namespace, "traffic", "peak_rate_bytes_per_second"), "Peak traffic rate streamed by Clash over the peak window.", []string{"direction"}, nil)
+	memoryInuse     = prometheus.NewDesc(prometheus.BuildFQName(namespace, "memory", "inuse_bytes"), "Memory in use streamed by Clash.", nil, nil)
+)
+
+type Traffic struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+type trafficSample struct {
+	Traffic
+	time time.Time
+}
+
+type Memory struct {
+	Inuse   int64 `json:"inuse"`
+	OSLimit int64 `json:"oslimit"`
+}
+
+// TrafficMonitor keeps the latest values of the /traffic and /memory streams.
+type TrafficMonitor struct {
+	mutex   sync.Mutex
+	traffic *Traffic
+	samples []trafficSample
+	memory  *Memory
+	window  time.Duration
+	now     func() time.Time
+}
+
+func NewTrafficMonitor(window time.Duration) *TrafficMonitor {
+	return &TrafficMonitor{window: window, now: time.Now}
+}
+
+func (m *TrafficMonitor) HandleTraffic(data []byte) error {
+	t := new(Traffic)
+	if err := json.Unmarshal(data, t); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	m.traffic = t
+	m.samples = append(m.expired(now), trafficSample{Traffic: *t, time: now})
+	return nil
+}
+
+func (m *TrafficMonitor) HandleMemory(data []byte) error {
+	mem := new(Memory)
+	if err := json.Unmarshal(data, mem); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.memory = mem
+	return nil
+}
+
+// Connected reports whether the traffic stream is delivering data.
+func (m *TrafficMonitor) Connected() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.traffic != nil
+}
+
+// ResetTraffic forgets the traffic after the stream is broken.
+func (m *TrafficMonitor) ResetTraffic(error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.traffic = nil
+	m.samples = nil
+}
+
+// ResetMemory forgets the memory usage after the stream is broken.
+func (m *TrafficMonitor) ResetMemory(error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.memory = nil
+}
+
+func (m *TrafficMonitor) Describe(descs chan<- *prometheus.Desc) {
+	descs <- trafficRate
+	descs <- trafficPeakRate
+	descs <- memoryInuse
+}
+
+// expired drops the samples that are older than the peak window.
+func (m *TrafficMonitor) expired(now time.Time) []trafficSample {
+	i := 0
+	for i < len(m.samples) && now.Sub(m.samples[i].time) > m.window {
+		i++
+	}
+	return m.samples[i:]
+}
+
+// Collect exports the latest values and the peak over the last window.
+func (m *TrafficMonitor) Collect(metrics chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if t := m.traffic; t != nil {
+		metrics <- prometheus.MustNewConstMetric(trafficRate, prometheus.GaugeValue, float64(t.Up), "up")
+		metrics <- prometheus.MustNewConstMetric(trafficRate, prometheus.GaugeValue, float64(t.Down), "down")
+		peak := *t
+		for _, s := range m.expired(m.now()) {
+			if s.Up > peak.Up {
+				peak.Up = s.Up
+			}
+			if s.Down > peak.Down {
+				peak.Down = s.Down
+			}
+		}
+		metrics <- prometheus.MustNewConstMetric(trafficPeakRate, prometheus.GaugeValue, float64(peak.Up), "up")
+		metrics <- prometheus.MustNewConstMetric(trafficPeakRate, prometheus.GaugeValue, float64(peak.Down), "down")
+	}
+	if m.memory != nil {
+		metrics <- prometheus.MustNewConstMetric(memoryInuse, prometheus.GaugeValue, float64(m.memory.Inuse))
+	}
+}